@@ -0,0 +1,314 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/lint/support"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// LintMessage holds one finding of LintChart
+type LintMessage struct {
+	// Severity is one of "info", "warning", "error" or "unknown"
+	Severity string
+	Path     string
+	Message  string
+}
+
+// ChartInfo holds what `helm show all` prints about a chart
+type ChartInfo struct {
+	Metadata *chart.Metadata
+	// Values is the raw content of values.yaml, comments included
+	Values string
+	// Readme is the content of the README file, empty without one
+	Readme string
+}
+
+// LintChart lints the chart directory or archive like `helm lint`.
+// Findings are returned as messages, the error is only set when the
+// chart could not be linted at all.
+func (h *HelmClient) LintChart(chartPath string, values map[string]interface{}) ([]LintMessage, error) {
+	// https://github.com/helm/helm/blob/master/pkg/action/lint.go
+	client := action.NewLint()
+	result := client.Run([]string{chartPath}, values)
+	if result.TotalChartsLinted == 0 {
+		if len(result.Errors) > 0 {
+			return nil, errors.Wrapf(result.Errors[0], "failed to lint chart %s", chartPath)
+		}
+		return nil, errors.Errorf("failed to lint chart %s", chartPath)
+	}
+
+	var messages []LintMessage
+	for _, msg := range result.Messages {
+		messages = append(messages, LintMessage{
+			Severity: lintSeverity(msg.Severity),
+			Path:     msg.Path,
+			Message:  msg.Err.Error(),
+		})
+	}
+	return messages, nil
+}
+
+// PackageChart packages the chart directory into a versioned archive in
+// destDir like `helm package` and returns the archive path. Non-empty
+// version and appVersion override the ones in Chart.yaml.
+func (h *HelmClient) PackageChart(chartPath, destDir string, version, appVersion string) (string, error) {
+	if ok, err := chartutil.IsChartDir(chartPath); !ok {
+		return "", errors.Wrapf(err, "%s is not a chart directory", chartPath)
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/package.go
+	client := action.NewPackage()
+	client.Destination = destDir
+	client.Version = version
+	client.AppVersion = appVersion
+	archivePath, err := client.Run(chartPath, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to package chart %s", chartPath)
+	}
+	h.logger().Info("Packaged chart", "chart", chartPath, "archive", archivePath)
+	return archivePath, nil
+}
+
+// PullChart downloads chartName at version from the helm repository at
+// repoURL into destDir like `helm pull` and returns the archive path. With
+// an empty repoURL chartName is resolved against the configured repositories,
+// version may be a semver constraint like InstallChartFromRepo.
+// args["untar"] extracts the archive and returns the chart directory instead,
+// args["username"] and args["password"] authenticate against protected repos.
+// args["verify"] also downloads the provenance file and fails unless it
+// verifies against args["keyring"] like InstallChart.
+func (h *HelmClient) PullChart(repoURL, chartName, version, destDir string, args map[string]interface{}) (string, error) {
+	if strings.HasPrefix(repoURL, "oci://") || strings.HasPrefix(chartName, "oci://") {
+		return "", errors.Wrapf(ErrOCINotSupported, "chart %s", chartName)
+	}
+	if err := validateVersionConstraint(version); err != nil {
+		return "", err
+	}
+	settings := h.newSettings()
+	username := stringArg(args, "username")
+	password := stringArg(args, "password")
+
+	// action.Pull only reports its output, download like it does to learn
+	// the archive path
+	// https://github.com/helm/helm/blob/master/pkg/action/pull.go
+	var out strings.Builder
+	dl := downloader.ChartDownloader{
+		Out:     &out,
+		Verify:  downloader.VerifyNever,
+		Keyring: keyringPath(stringArg(args, "keyring")),
+		Getters: getter.All(settings),
+		Options: []getter.Option{
+			getter.WithBasicAuth(username, password),
+		},
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+	}
+	if boolArg(args, "verify") {
+		dl.Verify = downloader.VerifyAlways
+	}
+
+	chartRef := chartName
+	if repoURL != "" {
+		chartURL, err := repo.FindChartInAuthRepoURL(repoURL, username, password, chartName, version, "", "", "", getter.All(settings))
+		if err != nil {
+			return "", err
+		}
+		chartRef = chartURL
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+	archivePath, _, err := dl.DownloadTo(chartRef, version, destDir)
+	if err != nil {
+		h.logger().Error(err, "Failed to pull helm chart", "chart", chartName, "repo", repoURL, "version", version, "output", out.String())
+		return "", errors.Wrapf(err, "failed to pull chart %s", chartName)
+	}
+	if !boolArg(args, "untar") {
+		return archivePath, nil
+	}
+
+	ch, err := loader.LoadFile(archivePath)
+	if err != nil {
+		return "", err
+	}
+	chartDir := filepath.Join(destDir, ch.Name())
+	if _, err := os.Stat(chartDir); err == nil {
+		return "", errors.Errorf("failed to untar: a file or directory with the name %s already exists", chartDir)
+	}
+	if err := chartutil.ExpandFile(destDir, archivePath); err != nil {
+		return "", errors.Wrap(err, "failed to untar")
+	}
+	// like helm pull --untar only the chart directory is kept
+	if err := os.Remove(archivePath); err != nil {
+		return "", err
+	}
+	return chartDir, nil
+}
+
+// BuildDependencies rebuilds the charts/ directory of the chart directory
+// from its Chart.lock like `helm dependency build`, so the exact locked
+// subchart versions are used. It fails when the lock file is missing or out
+// of sync with the dependencies in Chart.yaml.
+func (h *HelmClient) BuildDependencies(chartPath string) error {
+	ch, err := loader.LoadDir(chartPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load chart %s", chartPath)
+	}
+	if len(ch.Metadata.Dependencies) == 0 {
+		return nil
+	}
+	// Manager.Build falls back to resolving the dependencies without a lock
+	if ch.Lock == nil {
+		return errors.Errorf("chart %s has no lock file, update its dependencies first", chartPath)
+	}
+
+	settings := h.newSettings()
+	var out strings.Builder
+	// https://github.com/helm/helm/blob/master/pkg/downloader/manager.go
+	man := &downloader.Manager{
+		Out:              &out,
+		ChartPath:        chartPath,
+		Getters:          getter.All(settings),
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+		Debug:            settings.Debug,
+	}
+	if err := man.Build(); err != nil {
+		h.logger().Error(err, "Failed to build chart dependencies", "chart", chartPath, "output", out.String())
+		return errors.Wrapf(err, "failed to build dependencies of chart %s", chartPath)
+	}
+	h.logger().Info("Built chart dependencies", "chart", chartPath, "output", out.String())
+	return nil
+}
+
+// ShowChart returns the metadata, default values and README of the chart
+// without installing it like `helm show all`. chartPath is a local chart
+// directory or archive, or a reference like "bitnami/nginx" to the latest
+// version in a configured repository.
+func (h *HelmClient) ShowChart(chartPath string) (*ChartInfo, error) {
+	if strings.HasPrefix(chartPath, "oci://") {
+		return nil, errors.Wrapf(ErrOCINotSupported, "chart %s", chartPath)
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/show.go
+	var chartPathOptions action.ChartPathOptions
+	localPath, err := chartPathOptions.LocateChart(chartPath, h.newSettings())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to locate chart %s", chartPath)
+	}
+	ch, err := loader.Load(localPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load chart %s", chartPath)
+	}
+
+	info := &ChartInfo{Metadata: ch.Metadata}
+	for _, f := range ch.Raw {
+		if f.Name == chartutil.ValuesfileName {
+			info.Values = string(f.Data)
+		}
+	}
+	for _, f := range ch.Files {
+		if isReadme(f.Name) {
+			info.Readme = string(f.Data)
+			break
+		}
+	}
+	return info, nil
+}
+
+// ComputeValues returns the values an install of the chart would render
+// with: the chart defaults, overridden by the values file, overridden by
+// the set args as in InstallChart. An empty valuesPath uses no values file.
+func (h *HelmClient) ComputeValues(chartPath, valuesPath string, args map[string]interface{}) (map[string]interface{}, error) {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	localPath, cleanup, err := h.fetchChart(chartPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	ch, err := h.loadChart(localPath, false)
+	if err != nil {
+		return nil, err
+	}
+	return computeValues(ch, valuesPath, opts)
+}
+
+// ValidateValues validates the values computed like ComputeValues against
+// the values.schema.json of the chart and its subcharts, as an install
+// would. The error lists every violation, charts without a schema always
+// pass.
+func (h *HelmClient) ValidateValues(chartPath, valuesPath string, args map[string]interface{}) error {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return err
+	}
+	localPath, cleanup, err := h.fetchChart(chartPath, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	ch, err := h.loadChart(localPath, false)
+	if err != nil {
+		return err
+	}
+	vals, err := computeValues(ch, valuesPath, opts)
+	if err != nil {
+		return err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/chartutil/jsonschema.go
+	if err := chartutil.ValidateAgainstSchema(ch, vals); err != nil {
+		return errors.Wrapf(err, "values don't meet the specifications of the schema(s) of chart %s", chartPath)
+	}
+	return nil
+}
+
+func computeValues(ch *chart.Chart, valuesPath string, opts InstallOptions) (map[string]interface{}, error) {
+	vals, err := getValuesMulti([]string{valuesPath})
+	if err != nil {
+		return nil, err
+	}
+	if err := parseSetValues(opts, vals); err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/chartutil/coalesce.go
+	computed, err := chartutil.CoalesceValues(ch, vals)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compute values of chart %s", ch.Name())
+	}
+	return computed, nil
+}
+
+// isReadme tells whether the chart file is the README shown by `helm show`
+func isReadme(name string) bool {
+	for _, readme := range []string{"readme.md", "readme.txt", "readme"} {
+		if strings.EqualFold(name, readme) {
+			return true
+		}
+	}
+	return false
+}
+
+func lintSeverity(severity int) string {
+	switch severity {
+	case support.InfoSev:
+		return "info"
+	case support.WarningSev:
+		return "warning"
+	case support.ErrorSev:
+		return "error"
+	}
+	return "unknown"
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// newTestRepo serves a chart repository with testChart packaged at the
+// versions, requiring basic auth when username is set
+func newTestRepo(t *testing.T, username, password string, versions ...string) *httptest.Server {
+	t.Helper()
+	h := NewHelmClientForTesting()
+	dir := t.TempDir()
+	for _, version := range versions {
+		if _, err := h.PackageChart(testChart, dir, version, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); username != "" && (user != username || pass != password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	index, err := repo.IndexDirectory(dir, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.WriteFile(filepath.Join(dir, "index.yaml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestLintChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tests := []struct {
+		chartPath string
+		wantError bool
+	}{
+		{testChart, false},
+		{"testdata/brokenchart", true},
+	}
+	for _, tt := range tests {
+		messages, err := h.LintChart(tt.chartPath, nil)
+		if err != nil {
+			t.Fatalf("failed to lint %s: %v", tt.chartPath, err)
+		}
+		hasError := false
+		for _, msg := range messages {
+			if msg.Severity == "error" {
+				hasError = true
+			}
+		}
+		if hasError != tt.wantError {
+			t.Errorf("lint of %s has error messages %v, want %v: %+v", tt.chartPath, hasError, tt.wantError, messages)
+		}
+	}
+
+	if _, err := h.LintChart("testdata/missing", nil); err == nil {
+		t.Error("linting a missing chart returned no error")
+	}
+}
+
+func TestPackageChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	destDir := filepath.Join(t.TempDir(), "dist")
+
+	archivePath, err := h.PackageChart(testChart, destDir, "0.2.0", "2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(destDir, "mychart-0.2.0.tgz"); archivePath != want {
+		t.Errorf("got archive %s, want %s", archivePath, want)
+	}
+	if _, err := os.Stat(archivePath); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := loader.Load(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Metadata.Version != "0.2.0" || ch.Metadata.AppVersion != "2.0.0" {
+		t.Errorf("got chart version %s app version %s, want 0.2.0 and 2.0.0", ch.Metadata.Version, ch.Metadata.AppVersion)
+	}
+
+	if _, err := h.PackageChart("testdata/missing", destDir, "", ""); err == nil {
+		t.Error("packaging a missing chart returned no error")
+	}
+}
+
+func TestPullChart(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	server := newTestRepo(t, "user", "secret", "0.1.0", "0.2.0")
+	credentials := map[string]interface{}{"username": "user", "password": "secret"}
+
+	destDir := t.TempDir()
+	archivePath, err := h.PullChart(server.URL, "mychart", "0.1.0", destDir, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(destDir, "mychart-0.1.0.tgz"); archivePath != want {
+		t.Errorf("got archive %s, want %s", archivePath, want)
+	}
+	if _, err := loader.Load(archivePath); err != nil {
+		t.Errorf("failed to load the pulled chart: %v", err)
+	}
+
+	untarArgs := map[string]interface{}{"username": "user", "password": "secret", "untar": true}
+	chartDir, err := h.PullChart(server.URL, "mychart", "0.2.0", t.TempDir(), untarArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := loader.Load(chartDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Metadata.Version != "0.2.0" {
+		t.Errorf("got chart version %s in %s, want 0.2.0", ch.Metadata.Version, chartDir)
+	}
+
+	if _, err := h.PullChart(server.URL, "mychart", "0.1.0", t.TempDir(), nil); err == nil {
+		t.Error("pulling without credentials succeeded")
+	}
+}
+
+func TestBuildDependencies(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	parent := newParentChart(t)
+
+	if err := h.BuildDependencies(parent); err == nil {
+		t.Error("building the dependencies without a lock file succeeded")
+	}
+	// writes Chart.lock
+	if err := h.updateDependencies(parent); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(parent, "charts", "mychart-0.1.0.tgz")
+	if err := os.Remove(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.BuildDependencies(parent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loader.Load(archive); err != nil {
+		t.Errorf("the locked subchart was not built: %v", err)
+	}
+
+	chartYAML := filepath.Join(parent, "Chart.yaml")
+	data, err := os.ReadFile(chartYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := strings.Replace(string(data), "version: 0.1.0\n    repository", "version: 0.2.0\n    repository", 1)
+	writeTestFile(t, parent, "Chart.yaml", stale)
+	if err := h.BuildDependencies(parent); err == nil {
+		t.Error("building the dependencies with a stale lock file succeeded")
+	}
+}
+
+func TestShowChart(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+
+	info, err := h.ShowChart(testChart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata.Name != "mychart" || info.Metadata.Version != "0.1.0" || info.Metadata.AppVersion != "1.0.0" {
+		t.Errorf("got metadata %+v, want mychart 0.1.0 with app version 1.0.0", info.Metadata)
+	}
+	values, err := os.ReadFile(filepath.Join(testChart, "values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Values != string(values) {
+		t.Errorf("got values %q, want the content of values.yaml %q", info.Values, values)
+	}
+	if info.Readme != "" {
+		t.Errorf("got README %q for a chart without one", info.Readme)
+	}
+
+	dir := newParentChart(t)
+	writeTestFile(t, dir, "README.md", "# parentchart\n")
+	info, err = h.ShowChart(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Readme != "# parentchart\n" {
+		t.Errorf("got README %q, want the content of README.md", info.Readme)
+	}
+
+	server := newTestRepo(t, "", "", "0.1.0", "0.2.0")
+	if err := h.AddRepository("test", server.URL, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	info, err = h.ShowChart("test/mychart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata.Version != "0.2.0" {
+		t.Errorf("got version %s from the repository, want the latest 0.2.0", info.Metadata.Version)
+	}
+
+	if _, err := h.ShowChart("oci://registry.example.com/charts/mychart"); !errors.Is(err, ErrOCINotSupported) {
+		t.Errorf("got error %v for an OCI chart, want ErrOCINotSupported", err)
+	}
+}
+
+func TestInstallOCIChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	const chartPath = "oci://registry.example.com/charts/mychart"
+	_, errInstall := h.InstallChart("web", chartPath, "", testNamespace, nil)
+	_, errUpgrade := h.InstallUpgradeChart("web", chartPath, "", testNamespace, nil)
+	_, errTemplate := h.RenderTemplate("web", chartPath, "", testNamespace, nil)
+	_, errValues := h.ComputeValues(chartPath, "", nil)
+	errs := map[string]error{
+		"install":  errInstall,
+		"upgrade":  errUpgrade,
+		"template": errTemplate,
+		"values":   errValues,
+	}
+	for op, err := range errs {
+		if !errors.Is(err, ErrOCINotSupported) {
+			t.Errorf("%s of an OCI chart returned %v, want ErrOCINotSupported", op, err)
+		}
+	}
+}
+
+func TestComputeValues(t *testing.T) {
+	h := NewHelmClientForTesting()
+	valuesPath := writeTestFile(t, t.TempDir(), "values.yaml", "replicaCount: 2\nimage:\n  tag: \"1.20\"\n")
+
+	tests := []struct {
+		valuesPath string
+		args       map[string]interface{}
+		want       map[string]string
+	}{
+		{"", nil, map[string]string{"replicaCount": "1", "image.tag": "1.19", "image.repository": "nginx"}},
+		{valuesPath, nil, map[string]string{"replicaCount": "2", "image.tag": "1.20", "image.repository": "nginx"}},
+		{valuesPath, map[string]interface{}{"set": "replicaCount=3"}, map[string]string{"replicaCount": "3", "image.tag": "1.20", "image.repository": "nginx"}},
+	}
+	for _, tt := range tests {
+		vals, err := h.ComputeValues(testChart, tt.valuesPath, tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, want := range tt.want {
+			if got := fmt.Sprint(valueAt(vals, path)); got != want {
+				t.Errorf("values file %q, args %v: got %s=%s, want %s", tt.valuesPath, tt.args, path, got, want)
+			}
+		}
+	}
+
+	if _, err := h.ComputeValues(testChart, "missing.yaml", nil); err == nil {
+		t.Error("expected a missing values file to fail")
+	}
+}
+
+func TestValidateValues(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tests := []struct {
+		chartPath string
+		args      map[string]interface{}
+		wantErrs  []string
+	}{
+		{testChart, nil, nil},
+		{testSchemaChart, map[string]interface{}{"set": "database.host=db"}, nil},
+		{testSchemaChart, nil, []string{"host is required"}},
+		{testSchemaChart, map[string]interface{}{"set": "replicaCount=0"}, []string{"host is required", "replicaCount"}},
+	}
+	for _, tt := range tests {
+		err := h.ValidateValues(tt.chartPath, "", tt.args)
+		if tt.wantErrs == nil {
+			if err != nil {
+				t.Errorf("ValidateValues(%s, %v) failed: %v", tt.chartPath, tt.args, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("ValidateValues(%s, %v) succeeded, want violations %v", tt.chartPath, tt.args, tt.wantErrs)
+			continue
+		}
+		for _, want := range tt.wantErrs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("ValidateValues(%s, %v) = %v, want it to report %q", tt.chartPath, tt.args, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxChartDownloadSize bounds the size of chart archives, and their
+// provenance files, downloaded from http(s) chart paths
+const maxChartDownloadSize = 20 << 20
+
+// defaultDownloadTimeout is used for chart downloads when
+// InstallOptions.DownloadTimeout is not set
+const defaultDownloadTimeout = 2 * time.Minute
+
+// isChartURL tells whether the chart path is the http(s) URL of a chart
+// archive
+func isChartURL(chartPath string) bool {
+	return strings.HasPrefix(chartPath, "http://") || strings.HasPrefix(chartPath, "https://")
+}
+
+// fetchChart downloads the chart archive when chartPath is an http(s) URL,
+// which loader.Load cannot read, and returns the path of the local copy and
+// a cleanup func removing it. Other chart paths are returned as is, except
+// oci:// references, which return ErrOCINotSupported.
+// opts.DownloadTimeout bounds the download, proxies are taken from the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment like helm does.
+// opts.ChartSHA256 is the expected hex sha256 digest of the archive, with
+// opts.Verify the provenance file at the URL with ".prov" appended is
+// downloaded next to the archive.
+func (h *HelmClient) fetchChart(chartPath string, opts InstallOptions) (string, func(), error) {
+	noCleanup := func() {}
+	if strings.HasPrefix(chartPath, "oci://") {
+		return "", noCleanup, errors.Wrapf(ErrOCINotSupported, "chart %s", chartPath)
+	}
+	if !isChartURL(chartPath) {
+		return chartPath, noCleanup, nil
+	}
+	chartURL, err := url.Parse(chartPath)
+	if err != nil {
+		return "", noCleanup, errors.Wrapf(err, "invalid chart URL %s", chartPath)
+	}
+	timeout := opts.DownloadTimeout
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+
+	dir, err := os.MkdirTemp("", "helm-chart-")
+	if err != nil {
+		return "", noCleanup, err
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			h.logger().Error(err, "Failed to remove downloaded chart", "dir", dir)
+		}
+	}
+	// keep the archive name, downloader.VerifyChart expects the .prov file
+	// next to it
+	name := path.Base(chartURL.Path)
+	if name == "." || name == "/" {
+		name = "chart.tgz"
+	}
+	archivePath := filepath.Join(dir, name)
+
+	// http.DefaultTransport uses http.ProxyFromEnvironment
+	client := &http.Client{Timeout: timeout}
+	digest, err := downloadFile(client, chartPath, archivePath)
+	if err != nil {
+		cleanup()
+		return "", noCleanup, err
+	}
+	if want := opts.ChartSHA256; want != "" && !strings.EqualFold(want, digest) {
+		cleanup()
+		return "", noCleanup, errors.Errorf("chart %s has sha256 digest %s, expected %s", chartPath, digest, want)
+	}
+	if opts.Verify {
+		if _, err := downloadFile(client, chartPath+".prov", archivePath+".prov"); err != nil {
+			cleanup()
+			return "", noCleanup, err
+		}
+	}
+	h.logger().Info("Downloaded chart", "chart", chartPath, "archive", archivePath)
+	return archivePath, cleanup, nil
+}
+
+// downloadFile writes the body of a GET of fileURL to dest, at most
+// maxChartDownloadSize bytes, and returns its hex sha256 digest
+func downloadFile(client *http.Client, fileURL, dest string) (string, error) {
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to download %s", fileURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to download %s: %s", fileURL, resp.Status)
+	}
+	if resp.ContentLength > maxChartDownloadSize {
+		return "", errors.Errorf("failed to download %s: larger than %d bytes", fileURL, maxChartDownloadSize)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, maxChartDownloadSize+1))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to download %s", fileURL)
+	}
+	if n > maxChartDownloadSize {
+		return "", errors.Errorf("failed to download %s: larger than %d bytes", fileURL, maxChartDownloadSize)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
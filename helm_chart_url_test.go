@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newChartServer serves testChart packaged as mychart-0.1.0.tgz and returns
+// the archive URL with its hex sha256 digest
+func newChartServer(t *testing.T) (string, string) {
+	t.Helper()
+	h := NewHelmClientForTesting()
+	dir := t.TempDir()
+	archive, err := h.PackageChart(testChart, dir, "0.1.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(archive), hex.EncodeToString(sum[:])
+}
+
+func TestInstallChartURL(t *testing.T) {
+	chartURL, digest := newChartServer(t)
+	h := NewHelmClientForTesting()
+
+	result, err := h.InstallChart("web", chartURL, testValues, testNamespace, map[string]interface{}{
+		"chartSHA256":     strings.ToUpper(digest),
+		"downloadTimeout": "10s",
+	})
+	if err != nil {
+		t.Fatalf("failed to install from %s: %v", chartURL, err)
+	}
+	if result.Revision != 1 || !strings.Contains(result.Manifest, "kind: Deployment") {
+		t.Errorf("install from URL returned revision %d with manifest %q", result.Revision, result.Manifest)
+	}
+	// the downloaded archive is removed after loading
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "helm-chart-*", "mychart-0.1.0.tgz")); len(matches) != 0 {
+		t.Errorf("downloaded archives were not cleaned up: %v", matches)
+	}
+
+	tests := []struct {
+		name     string
+		chartURL string
+		args     map[string]interface{}
+		wantErr  string
+	}{
+		{"digest mismatch", chartURL, map[string]interface{}{"chartSHA256": strings.Repeat("0", 64)}, "sha256 digest"},
+		{"not found", chartURL + ".missing", nil, "404"},
+		{"invalid timeout", chartURL, map[string]interface{}{"downloadTimeout": "soon"}, "downloadTimeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.InstallChart("failed", tt.chartURL, testValues, testNamespace, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("InstallChart() returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
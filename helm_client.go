@@ -1,19 +1,46 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage/driver"
 	"helm.sh/helm/v3/pkg/strvals"
-
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/resource"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/yaml"
 )
@@ -21,53 +48,412 @@ import (
 //https://pkg.go.dev/helm.sh/helm/v3
 
 var (
-	// TODO get latest helm so that we dont need to copy following error
-	// Copied from https://github.com/helm/helm/blob/master/pkg/storage/driver/driver.go
 	// ErrNoDeployedReleases indicates that there are no releases with the given key in the deployed state
-	ErrNoDeployedReleases = errors.New("has no deployed releases")
-
-	settings *cli.EnvSettings
+	ErrNoDeployedReleases = driver.ErrNoDeployedReleases
+	// ErrReleaseNotFound indicates that a release is not found.
+	ErrReleaseNotFound = driver.ErrReleaseNotFound
+	// ErrReleaseAlreadyExists is returned when installing a release whose
+	// name is still in use.
+	ErrReleaseAlreadyExists = errors.New("release name is still in use")
+	// ErrOperationInProgress is returned when upgrading or rolling back a
+	// release whose latest revision is pending, see IsReleaseStuck.
+	ErrOperationInProgress = errors.New("another operation (install/upgrade/rollback) is in progress")
+	// ErrClientClosed is returned by the release operations of a closed
+	// client, see Close.
+	ErrClientClosed = errors.New("helm client is closed")
+	// ErrReleaseNotHealthy is returned by UpgradeIfHealthy for releases
+	// whose latest revision is not deployed.
+	ErrReleaseNotHealthy = errors.New("release is not deployed")
+	// ErrInvalidReleaseName is returned for release names helm rejects.
+	ErrInvalidReleaseName = errors.New("invalid release name, it must match ^(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])+$ and be at most 53 characters long")
+	// ErrInvalidRevision is returned when rolling back to a revision the
+	// release does not have.
+	ErrInvalidRevision = errors.New("invalid revision")
+	// ErrOCINotSupported is returned for oci:// repositories and charts in
+	// them, helm v3.2 only reads index based chart repositories.
+	ErrOCINotSupported = errors.New("oci chart references are not supported by this helm version")
 
 	helmLog = ctrl.Log.WithName("helm")
 )
 
+// defaultTimeout is used for waits and hooks when no timeout is set
+const defaultTimeout = 5 * time.Minute
+
+// defaultHistoryMax is the number of revisions kept per release unless
+// InstallOptions.HistoryMax is set, like the helm CLI
+const defaultHistoryMax = 10
+
+// defaultPollInterval is used by WaitForRelease when no interval is given
+const defaultPollInterval = 2 * time.Second
+
+const (
+	// defaultInitAttempts and defaultInitTimeout bound the retries of the
+	// action configuration initialization unless WithInitRetry is used
+	defaultInitAttempts = 3
+	defaultInitTimeout  = 30 * time.Second
+	// defaultInitBackoff is the delay before the first retry, doubled on
+	// every retry
+	defaultInitBackoff = 500 * time.Millisecond
+)
+
 type HelmInterface interface {
-	InstallChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) error
-	InstallUpgradeChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) error
-	UninstallChart(name, namespace string) error
+	InstallChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error)
+	InstallUpgradeChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error)
+	InstallChartWithOptions(name, chartPath, valuesPath, namespace string, opts InstallOptions) (*ReleaseResult, error)
+	InstallUpgradeChartWithOptions(name, chartPath, valuesPath, namespace string, opts InstallOptions) (*ReleaseResult, error)
+	UpgradeIfHealthy(name, chartPath, valuesPath, namespace string, opts InstallOptions) error
+	InstallLoadedChart(name string, ch *chart.Chart, vals map[string]interface{}, namespace string, opts InstallOptions) (*ReleaseResult, error)
+	RenderTemplate(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (string, error)
+	RenderTemplateFiles(chartPath, valuesPath string, showOnly []string, args map[string]interface{}) (map[string]string, error)
+	InstallCharts(specs []InstallSpec, concurrency int) []InstallResult
+	InstallChartMulti(name, chartPath string, valuesPaths []string, namespace string, args map[string]interface{}) (*ReleaseResult, error)
+	InstallChartFromRepo(name, repoURL, chartName, version, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error)
+	UninstallChart(name, namespace string, args map[string]interface{}) error
+	RollbackRelease(name, namespace string, revision int) error
+	InstallChartContext(ctx context.Context, name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error)
+	InstallUpgradeChartContext(ctx context.Context, name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error)
+	UninstallChartContext(ctx context.Context, name, namespace string, args map[string]interface{}) error
+	UninstallMatching(namespace, regexFilter string, keepHistory bool) ([]string, error)
+	RollbackReleaseContext(ctx context.Context, name, namespace string, revision int) error
+	RollbackReleaseWithOptions(name, namespace string, revision int, opts RollbackOptions) error
+	RollbackToLastDeployed(name, namespace string) (int, error)
 	ListReleases(namespace, filter string) ([]string, error)
+	ListReleasesDetailed(namespace, filter string) ([]ReleaseInfo, error)
+	ListReleasesWithOptions(namespace, filter string, opts ListOptions) ([]ReleaseInfo, error)
+	ListReleasesByStatus(namespace, filter string, statuses []release.Status) ([]ReleaseInfo, error)
+	ListAllReleases(filter string) ([]ReleaseInfo, error)
 	ReleaseExists(name, namespace string) (bool, error)
+	ReleaseExistsWithStatus(name, namespace string) (bool, release.Status, error)
+	InvalidateConfigCache(namespace string)
+	Close() error
+	ServerVersion(namespace string) (string, error)
+	LintChart(chartPath string, values map[string]interface{}) ([]LintMessage, error)
+	PackageChart(chartPath, destDir string, version, appVersion string) (string, error)
+	BuildDependencies(chartPath string) error
+	ShowChart(chartPath string) (*ChartInfo, error)
+	ComputeValues(chartPath, valuesPath string, args map[string]interface{}) (map[string]interface{}, error)
+	ValidateValues(chartPath, valuesPath string, args map[string]interface{}) error
+	PullChart(repoURL, chartName, version, destDir string, args map[string]interface{}) (string, error)
+	ListRepositories() ([]RepoEntry, error)
+	AddRepository(name, url, username, password string, force bool) error
+	RemoveRepository(name string) error
+	UpdateRepositories(names ...string) error
+	SearchRepo(keyword, versionConstraint string, devel bool) ([]SearchResult, error)
+	GetReleaseValues(name, namespace string, allValues bool) (map[string]interface{}, error)
+	GetHistory(name, namespace string, max int) ([]ReleaseRevision, error)
+	GetRelease(name, namespace string, revision int) (*release.Release, error)
+	GetReleaseManifest(name, namespace string, revision int) (string, error)
+	GetReleaseHooks(name, namespace string, events ...release.HookEvent) ([]HookInfo, error)
+	GetReleaseResources(name, namespace string, kinds ...string) ([]ResourceRef, error)
+	GetLiveReleaseResources(name, namespace string, kinds ...string) ([]ResourceRef, error)
+	GetReleaseNotes(name, namespace string, revision int) (string, error)
+	GetReleaseMetadata(name, namespace string) (*ReleaseMetadata, error)
+	GetCurrentRevision(name, namespace string) (int, error)
+	ExportRelease(name, namespace, destDir string) error
+	DiffRelease(name, namespace string, fromRevision, toRevision int) (string, error)
+	DiffUpgrade(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (string, error)
+	HasDrift(name, chartPath, valuesPath, namespace string, opts InstallOptions) (bool, string, error)
+	GetReleaseStatus(name, namespace string, showResources bool) (*ReleaseStatus, error)
+	IsReleaseStuck(name, namespace string, olderThan time.Duration) (bool, error)
+	ForceUnlock(name, namespace string) error
+	WaitForRelease(ctx context.Context, name, namespace string, desired release.Status, pollInterval time.Duration) error
+	RunReleaseTests(name, namespace string, timeout time.Duration, deletePods bool) (*TestResult, error)
+}
+
+// ReleaseInfo holds the details of a helm release
+type ReleaseInfo struct {
+	Name         string
+	Namespace    string
+	Revision     int
+	Status       string
+	ChartName    string
+	ChartVersion string
+	AppVersion   string
+	Updated      time.Time
+}
+
+// ReleaseRevision holds the details of one revision of a helm release
+type ReleaseRevision struct {
+	Revision    int
+	Status      string
+	Chart       string
+	AppVersion  string
+	Description string
+	Updated     time.Time
+}
+
+// ReleaseStatus holds the current state of a helm release
+type ReleaseStatus struct {
+	Name         string
+	Namespace    string
+	Status       string
+	Revision     int
+	LastDeployed time.Time
+	Description  string
+	Notes        string
+	Manifest     string
+	// Resources lists the live "Kind/name" resources of the release,
+	// only filled when requested
+	Resources []string
+}
+
+// ReleaseMetadata holds the chart a helm release revision runs
+type ReleaseMetadata struct {
+	ChartName    string
+	ChartVersion string
+	AppVersion   string
+	Revision     int
+}
+
+// TestResult holds the outcome of the test hooks of a release
+type TestResult struct {
+	Passed bool
+	Tests  []TestHookResult
+}
+
+// HookInfo holds the definition of one hook of a helm release
+type HookInfo struct {
+	Name   string
+	Kind   string
+	Events []string
+	Weight int
+	// DeletePolicies are the helm.sh/hook-delete-policy values
+	DeletePolicies []string
+}
+
+// TestHookResult holds the outcome and pod logs of one test hook
+type TestHookResult struct {
+	Name   string
+	Phase  string
+	Passed bool
+	Logs   string
+}
+
+// ReleaseResult holds the outcome of an install or upgrade
+type ReleaseResult struct {
+	Name      string
+	Namespace string
+	Revision  int
+	Manifest  string
+	Notes     string
+	// Unchanged is set when an upgrade was skipped because it would not
+	// change the deployed release
+	Unchanged bool
+	// Readiness reports the state of the release resources after waiting
+	// for them, only filled with InstallOptions.Wait. See ResourcesNotReadyError
+	// for waits timing out.
+	Readiness []ResourceReadiness
 }
 
 type HelmClient struct {
+	// helmMutex guards actionConfigs
 	helmMutex sync.Mutex
+	// actionConfigs caches the action configuration per namespace
+	actionConfigs map[string]*action.Configuration
+	log           logr.Logger
+	// initAttempts and initTimeout bound the retries of the action
+	// configuration initialization
+	initAttempts int
+	initTimeout  time.Duration
+	// initConfig initializes the action configuration of a namespace,
+	// initHelmActionConfig unless replaced by tests
+	initConfig func(namespace string) (*action.Configuration, error)
+	// initBackoff is the delay before the first retry of initConfig,
+	// defaultInitBackoff unless replaced by tests
+	initBackoff time.Duration
+	// kubeConfigPath and kubeContext override the ambient kubeconfig
+	// and its current context when set
+	kubeConfigPath string
+	kubeContext    string
+	// memory keeps the releases of every namespace without a cluster, see
+	// NewHelmClientForTesting
+	memory *memoryReleases
+	// eventHook is called with the stages of installs and upgrades, see
+	// WithEventHook
+	eventHook func(event HelmEvent)
+	// serverVersion caches the result of ServerVersion
+	serverVersion string
+	// closed is set by Close
+	closed bool
 }
 
 var _ HelmInterface = (*HelmClient)(nil)
 
 // NewHelmClient returns instance pointer
 func NewHelmClient() *HelmClient {
-	return &HelmClient{}
+	return &HelmClient{
+		actionConfigs: map[string]*action.Configuration{},
+	}
 }
 
-// getHelmActionConfig Helper function to get helm action configuration
-func (h *HelmClient) getHelmActionConfig(namespace string) (*action.Configuration, error) {
+// NewHelmClientWithConfig returns a client for the cluster of kubeContext in
+// the kubeconfig at kubeConfigPath instead of the ambient KUBECONFIG and its
+// current context. Empty values fall back to the defaults.
+func NewHelmClientWithConfig(kubeConfigPath, kubeContext string) (*HelmClient, error) {
+	h := NewHelmClient()
+	h.kubeConfigPath = kubeConfigPath
+	h.kubeContext = kubeContext
+
+	settings := h.newSettings()
+	rawConfig, err := newRESTClientGetter(settings, settings.Namespace()).ToRawKubeConfigLoader().RawConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load kubeconfig %s", kubeConfigPath)
+	}
+	if kubeContext != "" {
+		if _, ok := rawConfig.Contexts[kubeContext]; !ok {
+			return nil, errors.Errorf("context %q does not exist in kubeconfig %s", kubeContext, kubeConfigPath)
+		}
+	}
+	return h, nil
+}
+
+// WithLogger makes the client and helm actions log to logger instead of
+// the "helm" controller-runtime logger. Call it before using the client.
+func (h *HelmClient) WithLogger(logger logr.Logger) *HelmClient {
 	h.helmMutex.Lock()
 	defer h.helmMutex.Unlock()
 
-	err := os.Setenv("HELM_NAMESPACE", namespace)
-	if err != nil {
-		helmLog.Error(err,
-			"setenv HELM_NAMESPACE failed", "namespace", namespace)
+	h.log = logger
+	return h
+}
+
+// WithInitRetry makes the client try reaching the cluster of a namespace up
+// to maxAttempts times with exponential backoff when it first initializes
+// its action configuration, giving up after timeout. Only transient errors,
+// e.g. an overloaded or restarting API server, are retried. Call it before
+// using the client.
+func (h *HelmClient) WithInitRetry(maxAttempts int, timeout time.Duration) *HelmClient {
+	h.helmMutex.Lock()
+	defer h.helmMutex.Unlock()
+
+	h.initAttempts = maxAttempts
+	h.initTimeout = timeout
+	return h
+}
+
+func (h *HelmClient) logger() logr.Logger {
+	if h.log == nil {
+		return helmLog
 	}
-	settings := cli.New()
+	return h.log
+}
+
+// getHelmActionConfig Helper function to get helm action configuration.
+// Every caller gets its own copy of the cached configuration as actions
+// set fields on it, e.g. Capabilities or the client only kube client.
+func (h *HelmClient) getHelmActionConfig(namespace string) (*action.Configuration, error) {
+	return h.getHelmActionConfigContext(context.Background(), namespace)
+}
+
+// getHelmActionConfigContext is getHelmActionConfig with the retries of the
+// initialization bounded by ctx
+func (h *HelmClient) getHelmActionConfigContext(ctx context.Context, namespace string) (*action.Configuration, error) {
+	h.helmMutex.Lock()
+	cfg, ok := h.actionConfigs[namespace]
+	attempts, timeout, closed := h.initAttempts, h.initTimeout, h.closed
+	h.helmMutex.Unlock()
+	if closed {
+		return nil, ErrClientClosed
+	}
+
+	if !ok {
+		var err error
+		// retry without holding the lock so other namespaces are not blocked
+		cfg, err = h.initHelmActionConfigWithRetry(ctx, namespace, attempts, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		h.helmMutex.Lock()
+		// Close may have been called while initializing
+		if h.closed {
+			h.helmMutex.Unlock()
+			return nil, ErrClientClosed
+		}
+		if h.actionConfigs == nil {
+			h.actionConfigs = map[string]*action.Configuration{}
+		}
+		// a concurrent call may have initialized the namespace meanwhile,
+		// share its configuration so the releases of a memory driver are
+		// not split between two
+		if cached, ok := h.actionConfigs[namespace]; ok {
+			cfg = cached
+		} else {
+			h.actionConfigs[namespace] = cfg
+		}
+		h.helmMutex.Unlock()
+	}
+	return copyActionConfig(cfg), nil
+}
+
+// copyActionConfig returns a copy of cfg with its own storage, Upgrade.Run
+// sets the MaxHistory of the storage so calls must not share it
+func copyActionConfig(cfg *action.Configuration) *action.Configuration {
+	cfgCopy := *cfg
+	if cfg.Releases != nil {
+		releases := *cfg.Releases
+		cfgCopy.Releases = &releases
+	}
+	return &cfgCopy
+}
+
+// initHelmActionConfigWithRetry initializes the action configuration and
+// checks that the cluster is reachable, see pingCluster. Transient errors are
+// retried with exponential backoff for at most attempts times and timeout,
+// or until ctx is done.
+func (h *HelmClient) initHelmActionConfigWithRetry(ctx context.Context, namespace string, attempts int, timeout time.Duration) (*action.Configuration, error) {
+	if attempts <= 0 {
+		attempts = defaultInitAttempts
+	}
+	if timeout <= 0 {
+		timeout = defaultInitTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	initConfig := h.initConfig
+	if initConfig == nil {
+		initConfig = h.initHelmActionConfig
+	}
+	backoff := h.initBackoff
+	if backoff <= 0 {
+		backoff = defaultInitBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		cfg, err := initConfig(namespace)
+		// releases kept in memory have no cluster to reach
+		if err == nil && h.memory == nil {
+			err = pingCluster(ctx, cfg)
+		}
+		if err == nil {
+			return cfg, nil
+		}
+		if attempt >= attempts || !isTransientError(err) {
+			return nil, errors.Wrapf(err, "failed to reach the cluster of namespace %s", namespace)
+		}
+		h.logger().Error(err, "Failed to reach the cluster, retrying",
+			"namespace", namespace, "attempt", attempt, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(err, "gave up reaching the cluster of namespace %s: %s", namespace, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (h *HelmClient) initHelmActionConfig(namespace string) (*action.Configuration, error) {
+	if h.memory != nil {
+		return h.newTestingActionConfig(namespace), nil
+	}
+	settings := h.newSettings()
 	cfg := new(action.Configuration)
-	err = cfg.Init(
-		settings.RESTClientGetter(),
+	err := cfg.Init(
+		newRESTClientGetter(settings, namespace),
 		namespace,
 		os.Getenv("HELM_DRIVER"),
 		func(format string, args ...interface{}) {
-			helmLog.Info(fmt.Sprintf(format, args...))
+			h.logger().Info(fmt.Sprintf(format, args...))
 		})
 	if err != nil {
 		return nil, err
@@ -75,182 +461,2052 @@ func (h *HelmClient) getHelmActionConfig(namespace string) (*action.Configuratio
 	return cfg, nil
 }
 
-// InstallChart
-func (h *HelmClient) InstallChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) error {
-	actionConfig, err := h.getHelmActionConfig(namespace)
+// pingCluster fetches the version of the API server. cfg.Init only builds
+// lazy clients, so this is the first request that reaches the cluster.
+func pingCluster(ctx context.Context, cfg *action.Configuration) error {
+	clientSet, err := cfg.KubernetesClientSet()
 	if err != nil {
 		return err
 	}
-	// https://github.com/helm/helm/blob/master/pkg/action/install.go
-	client := action.NewInstall(actionConfig)
+	// like Discovery().ServerVersion(), which takes no context in client-go
+	// v0.18
+	return clientSet.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
 
-	if client.Version == "" && client.Devel {
-		client.Version = ">0.0.0-0"
+// isTransientError tells whether err is worth retrying, e.g. a network
+// timeout, a refused connection of a restarting API server or an overloaded
+// one. Errors like a bad kubeconfig or missing permissions are not.
+func isTransientError(err error) bool {
+	// the apierrors checks of apimachinery v0.18 do not unwrap
+	err = errors.Cause(err)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) {
+		return true
+	}
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err)
+}
+
+// newSettings returns the helm environment settings with the kubeconfig
+// overrides of the client applied
+func (h *HelmClient) newSettings() *cli.EnvSettings {
+	settings := cli.New()
+	if h.kubeConfigPath != "" {
+		settings.KubeConfig = h.kubeConfigPath
+	}
+	if h.kubeContext != "" {
+		settings.KubeContext = h.kubeContext
+	}
+	return settings
+}
+
+// newRESTClientGetter returns the kube client config of settings scoped to
+// namespace, settings.RESTClientGetter() would read it from HELM_NAMESPACE
+func newRESTClientGetter(settings *cli.EnvSettings, namespace string) genericclioptions.RESTClientGetter {
+	clientConfig := kube.GetConfig(settings.KubeConfig, settings.KubeContext, namespace)
+	if settings.KubeToken != "" {
+		clientConfig.BearerToken = &settings.KubeToken
+	}
+	if settings.KubeAPIServer != "" {
+		clientConfig.APIServer = &settings.KubeAPIServer
+	}
+	return clientConfig
+}
+
+// InvalidateConfigCache drops the cached action configuration of namespace
+// so that it is rebuilt, e.g. after kubeconfig changes. The cached server
+// version is dropped too.
+func (h *HelmClient) InvalidateConfigCache(namespace string) {
+	h.helmMutex.Lock()
+	defer h.helmMutex.Unlock()
+
+	delete(h.actionConfigs, namespace)
+	h.serverVersion = ""
+}
+
+// Close drops the cached action configurations. The client cannot be used
+// afterwards, its release operations fail with ErrClientClosed; chart and
+// repository operations, which keep no state, still work. Closing a closed
+// client is a no-op.
+func (h *HelmClient) Close() error {
+	h.helmMutex.Lock()
+	defer h.helmMutex.Unlock()
+
+	h.closed = true
+	h.actionConfigs = nil
+	h.serverVersion = ""
+	return nil
+}
+
+// ServerVersion returns the Kubernetes version of the cluster, e.g.
+// "v1.18.6". It is discovered once per client, namespace only picks the
+// action configuration to discover it with.
+func (h *HelmClient) ServerVersion(namespace string) (string, error) {
+	h.helmMutex.Lock()
+	version := h.serverVersion
+	h.helmMutex.Unlock()
+	if version != "" {
+		return version, nil
 	}
 
-	client.ReleaseName = name
-	chart, err := loader.Load(chartPath)
+	actionConfig, err := h.getHelmActionConfig(namespace)
 	if err != nil {
+		return "", err
+	}
+	if actionConfig.Capabilities != nil {
+		// set up front by NewHelmClientForTesting
+		version = actionConfig.Capabilities.KubeVersion.Version
+	} else {
+		dc, err := actionConfig.RESTClientGetter.ToDiscoveryClient()
+		if err != nil {
+			return "", errors.Wrap(err, "could not get Kubernetes discovery client")
+		}
+		info, err := dc.ServerVersion()
+		if err != nil {
+			return "", errors.Wrap(err, "could not get server version from Kubernetes")
+		}
+		version = info.GitVersion
+	}
+
+	h.helmMutex.Lock()
+	h.serverVersion = version
+	h.helmMutex.Unlock()
+	return version, nil
+}
+
+// runWithContext runs fn and returns ctx.Err() as soon as ctx is done.
+// helm v3.2 actions do not accept a context, so fn keeps running in the
+// background after cancellation; only the caller is unblocked. fn checks
+// ctx right before running the action, so a cancellation before that aborts
+// it. Callers pass the deadline of ctx on to the action as its timeout, see
+// contextTimeout, so that its waits and hooks end with ctx.
+func runWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	vals, err := getValues(valuesPath)
-	if err != nil {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+	select {
+	case err := <-errCh:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	// Add args
-	var setVals interface{}
-	if val, ok := args["set"]; ok {
-		setVals = val
-		if setVals != nil {
-			if err := strvals.ParseInto(setVals.(string), vals); err != nil {
-				return errors.Wrap(err, "failed parsing --set data")
-			}
+// contextTimeout caps timeout to the time left until the deadline of ctx
+func contextTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			return remaining
 		}
 	}
+	return timeout
+}
 
-	client.Namespace = namespace
-	// https://github.com/helm/helm/blob/master/pkg/release/release.go
-	_, err = client.Run(chart, vals)
+// contextArgs returns args with args["timeout"] capped by contextTimeout,
+// args itself is not modified
+func contextArgs(ctx context.Context, args map[string]interface{}) (map[string]interface{}, error) {
+	timeout, err := timeoutArg(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return err
+	capped := contextTimeout(ctx, timeout)
+	if capped == timeout {
+		return args, nil
+	}
+	ctxArgs := make(map[string]interface{}, len(args)+1)
+	for key, val := range args {
+		ctxArgs[key] = val
+	}
+	ctxArgs["timeout"] = capped.String()
+	return ctxArgs, nil
 }
 
-func getValues(valsPath string) (map[string]interface{}, error) {
-	_, err := os.Stat(valsPath)
-	if err != nil {
-		return nil, err
+// boolArg returns the bool value of args[key], false when unset
+func boolArg(args map[string]interface{}, key string) bool {
+	if val, ok := args[key]; ok {
+		if b, ok := val.(bool); ok {
+			return b
+		}
 	}
+	return false
+}
 
-	data, err := ioutil.ReadFile(valsPath)
-	if err != nil {
-		return nil, err
+const (
+	dryRunClient = "client"
+	dryRunServer = "server"
+)
+
+// dryRunArg returns the dry run strategy of args["dryRun"], empty for none.
+// Like `helm --dry-run` it is a bool, true meaning "client", or one of
+// "none", "client" and "server".
+func dryRunArg(args map[string]interface{}) (string, error) {
+	val, ok := args["dryRun"]
+	if !ok || val == nil {
+		return "", nil
+	}
+	switch dryRun := val.(type) {
+	case bool:
+		if dryRun {
+			return dryRunClient, nil
+		}
+		return "", nil
+	case string:
+		switch dryRun {
+		case "", "none", "false":
+			return "", nil
+		case dryRunClient, "true":
+			return dryRunClient, nil
+		case dryRunServer:
+			return dryRunServer, nil
+		}
+		return "", errors.Errorf("dryRun must be %q, %q or %q, got %q", "none", dryRunClient, dryRunServer, dryRun)
 	}
+	return "", errors.Errorf("dryRun must be a bool or string, got %T", val)
+}
 
-	var mapData map[string]interface{}
-	if err = yaml.Unmarshal([]byte(data), &mapData); err != nil {
-		return nil, err
+// stringArg returns the string value of args[key], empty when unset
+func stringArg(args map[string]interface{}, key string) string {
+	if val, ok := args[key]; ok {
+		if str, ok := val.(string); ok {
+			return str
+		}
 	}
-	return mapData, nil
+	return ""
 }
 
-func (h *HelmClient) InstallUpgradeChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) error {
-	actionConfig, err := h.getHelmActionConfig(namespace)
-	if err != nil {
-		return err
+// intArg returns the int value of args[key], def when unset
+func intArg(args map[string]interface{}, key string, def int) (int, error) {
+	val, ok := args[key]
+	if !ok || val == nil {
+		return def, nil
 	}
-	// https://github.com/helm/helm/blob/master/pkg/action/install.go
-	// https://github.com/fluxcd/helm-operator/blob/master/pkg/helm/options.go
-	client := action.NewUpgrade(actionConfig)
-	client.Install = true
+	i, ok := val.(int)
+	if !ok {
+		return 0, errors.Errorf("%s must be an int, got %T", key, val)
+	}
+	return i, nil
+}
+
+// timeoutArg parses args["timeout"] as a duration, defaultTimeout when unset
+func timeoutArg(args map[string]interface{}) (time.Duration, error) {
+	return durationArg(args, "timeout", defaultTimeout)
+}
 
-	chart, err := loader.Load(chartPath)
+// durationArg parses args[key] as a duration string, def when unset
+func durationArg(args map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	val, ok := args[key]
+	if !ok || val == nil {
+		return def, nil
+	}
+	durationStr, ok := val.(string)
+	if !ok {
+		return 0, errors.Errorf("%s must be a duration string, got %T", key, val)
+	}
+	duration, err := time.ParseDuration(durationStr)
 	if err != nil {
-		return err
+		return 0, errors.Wrapf(err, "failed parsing %s", key)
 	}
+	return duration, nil
+}
 
-	vals, err := getValues(valuesPath)
-	if err != nil {
-		helmLog.Error(err, "getvals failed", "vals", vals)
-		return err
+// postRendererArg returns args["postRenderer"], either a
+// postrender.PostRenderer or the path of a post-renderer executable
+func postRendererArg(args map[string]interface{}) (postrender.PostRenderer, error) {
+	val, ok := args["postRenderer"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	switch pr := val.(type) {
+	case postrender.PostRenderer:
+		return pr, nil
+	case string:
+		return postrender.NewExec(pr)
 	}
+	return nil, errors.Errorf("postRenderer must be a postrender.PostRenderer or an executable path, got %T", val)
+}
 
-	// Add args
-	var setVals interface{}
-	if val, ok := args["set"]; ok {
-		setVals = val
-		if setVals != nil {
-			if err := strvals.ParseInto(setVals.(string), vals); err != nil {
-				return errors.Wrap(err, "failed parsing --set data")
-			}
+// renderCapabilities returns the cluster capabilities client side renders
+// assume, helm's defaults with kubeVersion as Kubernetes version, when set,
+// and apiVersions added to the API versions
+func renderCapabilities(kubeVersion string, apiVersions []string) (*chartutil.Capabilities, error) {
+	caps := &chartutil.Capabilities{
+		KubeVersion: chartutil.DefaultCapabilities.KubeVersion,
+		APIVersions: append(chartutil.VersionSet{}, chartutil.DefaultVersionSet...),
+	}
+	if kubeVersion != "" {
+		v, err := semver.NewVersion(kubeVersion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid kubeVersion %q", kubeVersion)
+		}
+		caps.KubeVersion = chartutil.KubeVersion{
+			Version: "v" + v.String(),
+			Major:   strconv.FormatUint(v.Major(), 10),
+			Minor:   strconv.FormatUint(v.Minor(), 10),
 		}
 	}
+	caps.APIVersions = append(caps.APIVersions, apiVersions...)
+	return caps, nil
+}
 
-	client.Namespace = namespace
-	// https://github.com/helm/helm/blob/master/pkg/release/release.go
-	_, err = client.Run(name, chart, vals)
-	if err != nil {
-		helmLog.Error(err, "Failed to upgrade-install helm chart", "name", name, "namespace", namespace)
-		// https://github.com/helm/helm/blob/master/pkg/storage/driver/driver.go
-		// var errStr string
-		// fmt.Sscanf(errStr, "\"%s\" %s", name, "has no deployed releases")
-		// if err == errors.New(errStr) {
-		errInstall := h.InstallChart(name, chartPath, valuesPath, namespace, args)
-		if errInstall != nil {
-			helmLog.Error(err, "Failed to install helm chart", "name", name, "namespace", namespace)
-			return errInstall
-		} else {
-			return nil
+// serverDryRun submits the resources of the release manifest to the API
+// server with dryRun=All, so that schema validation, defaulting and
+// admission webhooks judge them without anything being persisted. Existing
+// resources are replaced rather than created. helm v3.2 has no
+// --dry-run=server, whose lookup functions still see no cluster here.
+func (h *HelmClient) serverDryRun(actionConfig *action.Configuration, rel *release.Release, validate bool) error {
+	resources, err := actionConfig.KubeClient.Build(bytes.NewBufferString(rel.Manifest), validate)
+	if err != nil {
+		return errors.Wrapf(err, "failed to build resources of release %s", rel.Name)
+	}
+	for _, info := range resources {
+		helper := resource.NewHelper(info.Client, info.Mapping).DryRun(true)
+		_, err := helper.Create(info.Namespace, true, info.Object)
+		if apierrors.IsAlreadyExists(err) {
+			_, err = helper.Replace(info.Namespace, info.Name, true, info.Object)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "server dry run of %s %s of release %s failed", info.Mapping.GroupVersionKind.Kind, info.Name, rel.Name)
 		}
 	}
+	h.logger().Info("Server dry run succeeded", "name", rel.Name, "namespace", rel.Namespace, "resources", len(resources))
 	return nil
 }
 
-// UninstallChart
-func (h *HelmClient) UninstallChart(name, namespace string) error {
-	//helm delete $name
-	actionConfig, err := h.getHelmActionConfig(namespace)
+// waitForJobs polls the Jobs of the release manifest until all completed,
+// for at most timeout. helm v3.2 has no --wait-for-jobs, its wait considers
+// a Job ready once created. A failed Job fails the wait, but is not rolled
+// back even for atomic upgrades.
+func (h *HelmClient) waitForJobs(actionConfig *action.Configuration, rel *release.Release, timeout time.Duration) error {
+	resources, err := actionConfig.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "failed to build resources of release %s", rel.Name)
 	}
-	client := action.NewUninstall(actionConfig)
-	_, err = client.Run(name)
+	var jobs []*resource.Info
+	for _, info := range resources {
+		gvk := info.Mapping.GroupVersionKind
+		if gvk.Group == batchv1.GroupName && gvk.Kind == "Job" {
+			jobs = append(jobs, info)
+		}
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	clientSet, err := actionConfig.KubernetesClientSet()
 	if err != nil {
-		return err
+		return errors.Wrap(err, "unable to get kubernetes client to wait for jobs")
+	}
+	err = wait.PollImmediate(defaultPollInterval, timeout, func() (bool, error) {
+		for _, info := range jobs {
+			job, err := clientSet.BatchV1().Jobs(info.Namespace).Get(context.Background(), info.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			complete := false
+			for _, cond := range job.Status.Conditions {
+				if cond.Status != corev1.ConditionTrue {
+					continue
+				}
+				switch cond.Type {
+				case batchv1.JobFailed:
+					return false, errors.Errorf("job %s of release %s failed: %s", info.Name, rel.Name, cond.Message)
+				case batchv1.JobComplete:
+					complete = true
+				}
+			}
+			if !complete {
+				h.logger().Info("Waiting for job to complete", "name", info.Name, "release", rel.Name)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		return errors.Wrapf(err, "jobs of release %s not complete within %s", rel.Name, timeout)
 	}
-	helmLog.Info("Uninstalled release", "name", name)
 	return err
 }
 
-func (h *HelmClient) isChartInstallable(ch *chart.Chart) (bool, error) {
-	switch ch.Metadata.Type {
-	case "", "application":
-		return true, nil
+// InstallChart is InstallChartWithOptions with the options as args, see
+// installOptionsFromArgs for the keys.
+//
+// Deprecated: use InstallChartWithOptions, which takes typed options.
+func (h *HelmClient) InstallChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error) {
+	return h.InstallChartContext(context.Background(), name, chartPath, valuesPath, namespace, args)
+}
+
+// InstallChartContext is InstallChart which returns early when ctx is done.
+// The deadline of ctx caps args["timeout"]. A cancellation once the install
+// is running only stops waiting for it, see runWithContext, so the state of
+// the release is unknown then.
+func (h *HelmClient) InstallChartContext(ctx context.Context, name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error) {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return nil, err
 	}
-	return false, errors.Errorf("%s charts are not installable", ch.Metadata.Type)
+	return h.installChartContext(ctx, name, chartPath, valuesPath, namespace, opts)
 }
 
-func (h *HelmClient) ListReleases(namespace, regexFilter string) ([]string, error) {
-	var releaseNames []string
-	var err error
+func (h *HelmClient) installChartContext(ctx context.Context, name, chartPath, valuesPath, namespace string, opts InstallOptions) (*ReleaseResult, error) {
+	opts.Timeout = contextTimeout(ctx, opts.timeout())
+	var rel *release.Release
+	err := runWithContext(ctx, func() error {
+		var err error
+		rel, err = h.installChart(ctx, name, chartPath, []string{valuesPath}, namespace, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.waitedReleaseResult(rel, namespace, opts), nil
+}
 
-	actionConfig, err := h.getHelmActionConfig(namespace)
+// InstallChartMulti is InstallChart with several values files merged in
+// order, later files overriding earlier ones like `helm -f a.yaml -f b.yaml`
+func (h *HelmClient) InstallChartMulti(name, chartPath string, valuesPaths []string, namespace string, args map[string]interface{}) (*ReleaseResult, error) {
+	opts, err := installOptionsFromArgs(args)
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
-	client := action.NewList(actionConfig)
-	if len(regexFilter) > 0 {
-		client.Filter = regexFilter
+	rel, err := h.installChart(context.Background(), name, chartPath, valuesPaths, namespace, opts)
+	if err != nil {
+		return nil, err
 	}
-	releases, err := client.Run()
+	return h.waitedReleaseResult(rel, namespace, opts), nil
+}
+
+func (h *HelmClient) installChart(ctx context.Context, name, chartPath string, valuesPaths []string, namespace string, opts InstallOptions) (*release.Release, error) {
+	actionConfig, err := h.installActionConfig(ctx, namespace, opts)
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
+	return h.installChartWithConfig(ctx, actionConfig, name, chartPath, valuesPaths, namespace, opts)
+}
 
-	for _, release := range releases {
-		releaseNames = append(releaseNames, release.Name)
+// installActionConfig returns the action configuration an install uses, a
+// client side one for dry runs
+func (h *HelmClient) installActionConfig(ctx context.Context, namespace string, opts InstallOptions) (*action.Configuration, error) {
+	if opts.dryRun() != dryRunClient {
+		return h.getHelmActionConfigContext(ctx, namespace)
 	}
+	// like ClientOnly, which would render with the shared and mutated
+	// chartutil.DefaultCapabilities instead of the ones from the options
+	actionConfig := h.newMemoryActionConfig(namespace)
+	caps, err := renderCapabilities(opts.KubeVersion, opts.APIVersions)
+	if err != nil {
+		return nil, err
+	}
+	actionConfig.Capabilities = caps
+	return actionConfig, nil
+}
 
-	return releaseNames, nil
+// installChartWithConfig installs with the given action configuration, which
+// must be a copy owned by the caller as the install modifies it
+func (h *HelmClient) installChartWithConfig(ctx context.Context, actionConfig *action.Configuration, name, chartPath string, valuesPaths []string, namespace string, opts InstallOptions) (*release.Release, error) {
+	return h.installWithConfig(ctx, actionConfig, name, chartPath, namespace, opts, func() (*chart.Chart, map[string]interface{}, error) {
+		localPath, cleanup, err := h.fetchChart(chartPath, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer cleanup()
+		if err := h.verifyChart(localPath, opts); err != nil {
+			return nil, nil, err
+		}
+		ch, err := h.loadChart(localPath, opts.DependencyUpdate)
+		if err != nil {
+			return nil, nil, err
+		}
+		vals, err := getValuesMulti(valuesPaths)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ch, vals, nil
+	})
 }
 
-func (h *HelmClient) ReleaseExists(name, namespace string) (bool, error) {
-	releases, err := h.ListReleases(namespace, "")
-	if err != nil {
-		return false, err
+// installWithConfig is installChartWithConfig with the chart and values
+// returned by load. chartRef names the chart in errors and, with
+// GenerateName, the generated release name.
+func (h *HelmClient) installWithConfig(ctx context.Context, actionConfig *action.Configuration, name, chartRef, namespace string, opts InstallOptions, load func() (*chart.Chart, map[string]interface{}, error)) (rel *release.Release, err error) {
+	// https://github.com/helm/helm/blob/master/pkg/action/install.go
+	client := action.NewInstall(actionConfig)
+	dryRun := opts.dryRun()
+	client.DryRun = dryRun != ""
+	client.DisableHooks = opts.NoHooks
+	client.Description = opts.Description
+	client.CreateNamespace = opts.CreateNamespace
+	client.SkipCRDs = opts.SkipCRDs
+	client.DisableOpenAPIValidation = opts.DisableOpenAPIValidation
+	client.IncludeCRDs = opts.IncludeCRDs && !client.SkipCRDs
+	client.Wait = opts.Wait
+	client.Timeout = opts.timeout()
+	client.PostRenderer = opts.PostRenderer
+
+	if client.Version == "" && client.Devel {
+		client.Version = ">0.0.0-0"
 	}
 
-	// TODO did not work
-	//if len(releases) != 1 {
-	//	return false, nil
-	//}
+	client.GenerateName = opts.GenerateName
+	client.NameTemplate = opts.NameTemplate
+	nameArgs := []string{chartRef}
+	if name != "" {
+		nameArgs = []string{name, chartRef}
+	}
+	client.ReleaseName, _, err = client.NameAndChart(nameArgs)
+	if err != nil {
+		return nil, err
+	}
+	// helm v3.2 only validates the names of upgrades
+	if !action.ValidName.MatchString(client.ReleaseName) {
+		return nil, errors.Wrapf(ErrInvalidReleaseName, "release %q", client.ReleaseName)
+	}
 
-	for _, releaseName := range releases {
-		if releaseName == name {
-			return true, nil
+	emit := noEvents
+	if !client.DryRun {
+		emit = h.newEventEmitter(client.ReleaseName, namespace)
+	}
+	defer func() {
+		if err != nil {
+			emit(EventFailed, err)
+			return
 		}
+		emit(EventSucceeded, nil)
+	}()
+	emit(EventLoadingChart, nil)
+	chart, vals, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.isChartInstallable(chart); err != nil {
+		return nil, errors.Wrapf(err, "cannot install chart %s", chartRef)
+	}
+
+	if err := parseSetValues(opts, vals); err != nil {
+		return nil, err
+	}
+
+	waitForJobs := opts.WaitForJobs
+	if waitForJobs && !client.Wait {
+		return nil, errors.New("waitForJobs requires wait")
+	}
+
+	client.Namespace = namespace
+	h.withEventKubeClient(actionConfig, emit)
+	// helm v3.2 only cleans up failed upgrades
+	var creates *createRecordingKubeClient
+	if opts.CleanupOnFail && !client.DryRun {
+		creates = &createRecordingKubeClient{Interface: actionConfig.KubeClient, releaseName: client.ReleaseName}
+		actionConfig.KubeClient = creates
+	}
+	emit(EventRendering, nil)
+	// the last chance to cancel, helm cannot stop a running install
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	// https://github.com/helm/helm/blob/master/pkg/release/release.go
+	rel, err = client.Run(chart, vals)
+	if err != nil {
+		err = h.waitError(actionConfig, rel, releaseError(err, client.ReleaseName, namespace), client.ReleaseName, client.Timeout)
+		if creates != nil && len(creates.created) > 0 {
+			h.logger().Error(err, "Failed to install helm chart, cleaning up", "name", client.ReleaseName, "namespace", namespace, "resources", len(creates.created))
+			if _, errs := creates.Interface.Delete(creates.created); len(errs) > 0 {
+				return nil, errors.Wrapf(err, "cleanup failed too: %s", utilerrors.NewAggregate(errs))
+			}
+		}
+		return nil, err
+	}
+	if dryRun == dryRunServer {
+		if err := h.serverDryRun(actionConfig, rel, !client.DisableOpenAPIValidation); err != nil {
+			return nil, err
+		}
+	}
+	if waitForJobs && !client.DryRun {
+		emit(EventWaiting, nil)
+		if err := h.waitForJobs(actionConfig, rel, client.Timeout-time.Since(start)); err != nil {
+			return nil, err
+		}
+	}
+	return rel, nil
+}
+
+// createRecordingKubeClient records the resources of the release it creates,
+// which helm annotates with the release name unlike hooks and namespaces
+type createRecordingKubeClient struct {
+	kube.Interface
+	releaseName string
+	created     kube.ResourceList
+}
+
+// Create records all the resources when it fails, the kube client does not
+// tell which ones it created then. The install checked that none of them
+// existed before and deleting the missing ones is skipped.
+func (c *createRecordingKubeClient) Create(resources kube.ResourceList) (*kube.Result, error) {
+	result, err := c.Interface.Create(resources)
+	if result != nil {
+		c.record(result.Created)
+	} else if err != nil {
+		c.record(resources)
+	}
+	return result, err
+}
+
+func (c *createRecordingKubeClient) Update(original, target kube.ResourceList, force bool) (*kube.Result, error) {
+	result, err := c.Interface.Update(original, target, force)
+	if result != nil {
+		c.record(result.Created)
+	}
+	return result, err
+}
+
+func (c *createRecordingKubeClient) record(resources kube.ResourceList) {
+	for _, info := range resources {
+		obj, err := meta.Accessor(info.Object)
+		if err == nil && obj.GetAnnotations()["meta.helm.sh/release-name"] == c.releaseName {
+			c.created.Append(info)
+		}
+	}
+}
+
+// RenderTemplate renders the chart client side like `helm template` and
+// returns the manifest without touching the cluster. args are the options
+// of InstallChart, see installOptionsFromArgs, plus args["includeHooks"],
+// which adds the hook manifests. args["includeCRDs"] adds the crds/
+// directory unless args["skipCRDs"] is set, args["kubeVersion"] and
+// args["apiVersions"] describe the cluster to render for.
+func (h *HelmClient) RenderTemplate(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (string, error) {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return "", err
+	}
+	opts.DryRun, opts.ServerDryRun = true, false
+
+	rel, err := h.installChart(context.Background(), name, chartPath, []string{valuesPath}, namespace, opts)
+	if err != nil {
+		return "", err
+	}
+
+	var manifests strings.Builder
+	manifests.WriteString(rel.Manifest)
+	if boolArg(args, "includeHooks") {
+		for _, hook := range rel.Hooks {
+			fmt.Fprintf(&manifests, "---\n# Source: %s\n%s\n", hook.Path, hook.Manifest)
+		}
+	}
+	return manifests.String(), nil
+}
+
+// RenderTemplateFiles renders the chart like RenderTemplate and returns the
+// rendered templates by their path in the chart, e.g. "templates/service.yaml".
+// Like `helm template --show-only` only templates matching one of the
+// showOnly paths or globs are returned, every template when it is empty, and
+// a path matching no template is an error. The release is rendered as
+// "release-name" in the default namespace unless args["namespace"] is set.
+func (h *HelmClient) RenderTemplateFiles(chartPath, valuesPath string, showOnly []string, args map[string]interface{}) (map[string]string, error) {
+	namespace := stringArg(args, "namespace")
+	if namespace == "" {
+		namespace = h.newSettings().Namespace()
+	}
+	manifest, err := h.RenderTemplate("release-name", chartPath, valuesPath, namespace, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// sources are prefixed with the chart name, show-only paths are not
+	// https://github.com/helm/helm/blob/master/cmd/helm/template.go
+	files := map[string]string{}
+	for source, doc := range splitManifestSources(manifest) {
+		parts := strings.SplitN(source, "/", 2)
+		if len(parts) == 2 {
+			files[parts[1]] = doc
+		}
+	}
+	if len(showOnly) == 0 {
+		return files, nil
+	}
+
+	shown := map[string]string{}
+	for _, pattern := range showOnly {
+		found := false
+		for path, doc := range files {
+			matched, err := filepath.Match(pattern, path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid template path %s", pattern)
+			}
+			if matched {
+				shown[path] = doc
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("could not find template %s in chart", pattern)
+		}
+	}
+	return shown, nil
+}
+
+// InstallSpec describes one chart install of InstallCharts
+type InstallSpec struct {
+	Name       string
+	ChartPath  string
+	ValuesPath string
+	Namespace  string
+	Args       map[string]interface{}
+}
+
+// InstallResult holds the outcome of one InstallSpec
+type InstallResult struct {
+	Spec    InstallSpec
+	Release *ReleaseResult
+	Err     error
+}
+
+// InstallCharts installs the specs with at most concurrency installs running
+// at a time and returns the results in the order of specs
+func (h *HelmClient) InstallCharts(specs []InstallSpec, concurrency int) []InstallResult {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]InstallResult, len(specs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				spec := specs[i]
+				rel, err := h.InstallChart(spec.Name, spec.ChartPath, spec.ValuesPath, spec.Namespace, spec.Args)
+				results[i] = InstallResult{Spec: spec, Release: rel, Err: err}
+			}
+		}()
+	}
+	for i := range specs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// InstallChartFromRepo downloads chartName at version from the helm repository
+// at repoURL and installs it like InstallChart. With an empty repoURL chartName
+// is resolved against the configured repositories, e.g. "bitnami/nginx".
+// version may be a semver constraint like "^1.2.0", the highest matching
+// version in the repository index is installed.
+// args["username"] and args["password"] authenticate against protected repos.
+func (h *HelmClient) InstallChartFromRepo(name, repoURL, chartName, version, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error) {
+	if err := validateVersionConstraint(version); err != nil {
+		return nil, err
+	}
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/install.go
+	chartPathOptions := action.ChartPathOptions{
+		RepoURL:  repoURL,
+		Version:  version,
+		Username: stringArg(args, "username"),
+		Password: stringArg(args, "password"),
+		Verify:   opts.Verify,
+		Keyring:  keyringPath(opts.Keyring),
+	}
+	chartPath, err := chartPathOptions.LocateChart(chartName, h.newSettings())
+	if err != nil {
+		h.logger().Error(err, "Failed to locate helm chart", "chart", chartName, "repo", repoURL, "version", version)
+		return nil, errors.Wrapf(err, "failed to locate chart %s matching version %q", chartName, version)
+	}
+	return h.InstallChartWithOptions(name, chartPath, valuesPath, namespace, opts)
+}
+
+// verifyChart checks the chart archive against its .prov file with the
+// keyring of the options when Verify is set. Unpacked chart directories
+// cannot be verified.
+func (h *HelmClient) verifyChart(chartPath string, opts InstallOptions) error {
+	if !opts.Verify {
+		return nil
+	}
+	if _, err := downloader.VerifyChart(chartPath, keyringPath(opts.Keyring)); err != nil {
+		h.logger().Error(err, "Failed to verify helm chart", "chart", chartPath)
+		return errors.Wrapf(err, "failed to verify chart %s", chartPath)
+	}
+	return nil
+}
+
+// keyringPath returns keyring, the default keyring of `helm --verify` when
+// empty
+func keyringPath(keyring string) string {
+	if keyring != "" {
+		return keyring
+	}
+	if gnupgHome, ok := os.LookupEnv("GNUPGHOME"); ok {
+		return filepath.Join(gnupgHome, "pubring.gpg")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// validateVersionConstraint checks that a chart version is a valid semver
+// constraint, an empty version means the latest one
+func validateVersionConstraint(version string) error {
+	if version == "" {
+		return nil
+	}
+	if _, err := semver.NewConstraint(version); err != nil {
+		return errors.Wrapf(err, "invalid chart version constraint %q", version)
+	}
+	return nil
+}
+
+// loadChart loads a chart from a local directory or archive, see fetchChart
+// for http(s) chart URLs. With
+// dependencyUpdate missing dependencies are downloaded into charts/ first,
+// like `helm install --dependency-update`.
+func (h *HelmClient) loadChart(chartPath string, dependencyUpdate bool) (*chart.Chart, error) {
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	req := ch.Metadata.Dependencies
+	if req == nil {
+		return ch, nil
+	}
+	if err := action.CheckDependencies(ch, req); err != nil {
+		if !dependencyUpdate {
+			return nil, err
+		}
+		if err := h.updateDependencies(chartPath); err != nil {
+			return nil, err
+		}
+		// Reload the chart with the updated Chart.lock file.
+		return loader.Load(chartPath)
+	}
+	return ch, nil
+}
+
+// updateDependencies runs `helm dependency update` on the chart directory
+func (h *HelmClient) updateDependencies(chartPath string) error {
+	settings := h.newSettings()
+	var out bytes.Buffer
+	// https://github.com/helm/helm/blob/master/pkg/downloader/manager.go
+	man := &downloader.Manager{
+		Out:              &out,
+		ChartPath:        chartPath,
+		SkipUpdate:       false,
+		Getters:          getter.All(settings),
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+		Debug:            settings.Debug,
+	}
+	if err := man.Update(); err != nil {
+		h.logger().Error(err, "Failed to update chart dependencies", "chart", chartPath, "output", out.String())
+		return errors.Wrapf(err, "failed to update dependencies of chart %s", chartPath)
+	}
+	h.logger().Info("Updated chart dependencies", "chart", chartPath, "output", out.String())
+	return nil
+}
+
+// getValues reads the values file, an empty valsPath means no values file
+// and gives no values
+func getValues(valsPath string) (map[string]interface{}, error) {
+	if valsPath == "" {
+		return map[string]interface{}{}, nil
+	}
+	_, err := os.Stat(valsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "values file %s", valsPath)
+	}
+
+	data, err := os.ReadFile(valsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mapData := map[string]interface{}{}
+	if err = yaml.Unmarshal(data, &mapData); err != nil {
+		return nil, err
+	}
+	// an empty file leaves a nil map that args could not be parsed into
+	if mapData == nil {
+		mapData = map[string]interface{}{}
+	}
+	return mapData, nil
+}
+
+// parseSetValues parses the SetJSON, Set, SetMap, SetString and SetFile
+// options into vals in that order, see InstallOptions
+func parseSetValues(opts InstallOptions, vals map[string]interface{}) error {
+	// like helm, JSON values are applied before --set ones
+	// https://github.com/helm/helm/blob/master/pkg/cli/values/options.go
+	if setJSON := opts.SetJSON; setJSON != "" {
+		var jsonVals map[string]interface{}
+		if err := json.Unmarshal([]byte(setJSON), &jsonVals); err != nil {
+			return errors.Wrap(err, "failed parsing --set-json data")
+		}
+		for key, merged := range mergeMaps(vals, jsonVals) {
+			vals[key] = merged
+		}
+	}
+	if set := opts.Set; set != "" {
+		if err := strvals.ParseInto(set, vals); err != nil {
+			return errors.Wrap(err, "failed parsing --set data")
+		}
+	}
+	if setMap := opts.SetMap; len(setMap) > 0 {
+		keys := make([]string, 0, len(setMap))
+		for key := range setMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := strvals.ParseInto(key+"="+escapeSetValue(setMap[key]), vals); err != nil {
+				return errors.Wrapf(err, "failed parsing setMap key %s", key)
+			}
+		}
+	}
+	if setString := opts.SetString; setString != "" {
+		if err := strvals.ParseIntoString(setString, vals); err != nil {
+			return errors.Wrap(err, "failed parsing --set-string data")
+		}
+	}
+	if setFile := opts.SetFile; setFile != "" {
+		reader := func(rs []rune) (interface{}, error) {
+			data, err := os.ReadFile(string(rs))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed reading --set-file %s", string(rs))
+			}
+			return string(data), nil
+		}
+		if err := strvals.ParseIntoFile(setFile, vals, reader); err != nil {
+			return errors.Wrap(err, "failed parsing --set-file data")
+		}
+	}
+	return nil
+}
+
+// setArg returns the string of the set flag args[key], empty when unset.
+// Unlike stringArg other types are an error rather than ignored.
+func setArg(args map[string]interface{}, key string) (string, error) {
+	val, ok := args[key]
+	if !ok || val == nil {
+		return "", nil
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", errors.Errorf("%s must be a string, got %T", key, val)
+	}
+	return str, nil
+}
+
+// escapeSetValue escapes the characters strvals would split a value at
+func escapeSetValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`).Replace(value)
+}
+
+// getValuesMulti merges the values files in order, later ones win
+func getValuesMulti(valsPaths []string) (map[string]interface{}, error) {
+	base := map[string]interface{}{}
+	for _, valsPath := range valsPaths {
+		vals, err := getValues(valsPath)
+		if err != nil {
+			return nil, err
+		}
+		base = mergeMaps(base, vals)
+	}
+	return base, nil
+}
+
+// Copied from https://github.com/helm/helm/blob/master/pkg/cli/values/options.go
+// mergeMaps deep merges b into a copy of a
+func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		if v, ok := v.(map[string]interface{}); ok {
+			if bv, ok := out[k]; ok {
+				if bv, ok := bv.(map[string]interface{}); ok {
+					out[k] = mergeMaps(bv, v)
+					continue
+				}
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// InstallUpgradeChart is InstallUpgradeChartWithOptions with the options as
+// args, see installOptionsFromArgs for the keys.
+//
+// Deprecated: use InstallUpgradeChartWithOptions, which takes typed options.
+func (h *HelmClient) InstallUpgradeChart(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error) {
+	return h.InstallUpgradeChartContext(context.Background(), name, chartPath, valuesPath, namespace, args)
+}
+
+// InstallUpgradeChartContext is InstallUpgradeChart which returns early when
+// ctx is done. The deadline of ctx caps args["timeout"]. A cancellation once
+// the upgrade is running only stops waiting for it, see runWithContext, so
+// the state of the release is unknown then.
+func (h *HelmClient) InstallUpgradeChartContext(ctx context.Context, name, chartPath, valuesPath, namespace string, args map[string]interface{}) (*ReleaseResult, error) {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return h.installUpgradeChartContext(ctx, name, chartPath, valuesPath, namespace, opts)
+}
+
+func (h *HelmClient) installUpgradeChartContext(ctx context.Context, name, chartPath, valuesPath, namespace string, opts InstallOptions) (*ReleaseResult, error) {
+	opts.Timeout = contextTimeout(ctx, opts.timeout())
+	var rel *release.Release
+	var unchanged bool
+	err := runWithContext(ctx, func() error {
+		var err error
+		rel, unchanged, err = h.installUpgradeChart(ctx, name, chartPath, valuesPath, namespace, opts, true)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unchanged {
+		result := newReleaseResult(rel)
+		result.Unchanged = true
+		return result, nil
+	}
+	return h.waitedReleaseResult(rel, namespace, opts), nil
+}
+
+// errUpgradeUnchanged is returned by unchangedPostRenderer to stop an
+// upgrade before it stores a new revision
+var errUpgradeUnchanged = errors.New("upgrade renders the deployed manifest")
+
+// unchangedPostRenderer runs the post renderer of the upgrade, if any, and
+// fails with errUpgradeUnchanged when the result is the manifest of the
+// deployed revision. The upgrade renders the manifest only once this way.
+type unchangedPostRenderer struct {
+	next     postrender.PostRenderer
+	manifest string
+}
+
+func (p unchangedPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	if p.next != nil {
+		var err error
+		if renderedManifests, err = p.next.Run(renderedManifests); err != nil {
+			return nil, err
+		}
+	}
+	if renderedManifests.String() == p.manifest {
+		return nil, errUpgradeUnchanged
+	}
+	return renderedManifests, nil
+}
+
+// sameChartAndValues tells whether the deployed revision runs the chart with
+// its metadata, templates and default values and vals as values, so that
+// the same manifest renders the same hooks too. vals are the values of the
+// upgrade after helm merged them with the deployed ones, see upgradeValues.
+func sameChartAndValues(deployed *release.Release, ch *chart.Chart, vals map[string]interface{}) bool {
+	if deployed.Chart == nil || len(deployed.Chart.Templates) != len(ch.Templates) {
+		return false
+	}
+	for i, tmpl := range ch.Templates {
+		if deployed.Chart.Templates[i].Name != tmpl.Name || !bytes.Equal(deployed.Chart.Templates[i].Data, tmpl.Data) {
+			return false
+		}
+	}
+	// stored charts and values went through JSON, compare them that way
+	for _, pair := range [][2]interface{}{
+		{deployed.Chart.Metadata, ch.Metadata},
+		{deployed.Chart.Values, ch.Values},
+		{deployed.Config, vals},
+	} {
+		a, errA := json.Marshal(pair[0])
+		b, errB := json.Marshal(pair[1])
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// upgradeValues returns the values an upgrade of the deployed revision with
+// vals stores, like the unexported reuseValues of the helm upgrade action
+func upgradeValues(deployed *release.Release, vals map[string]interface{}, reuseValues, resetValues bool) map[string]interface{} {
+	switch {
+	case resetValues:
+		return vals
+	case reuseValues:
+		return chartutil.CoalesceTables(copyValues(vals), deployed.Config)
+	case len(vals) == 0 && len(deployed.Config) > 0:
+		return deployed.Config
+	}
+	return vals
+}
+
+// installUpgradeChart upgrades the release, with skipUnchanged it returns
+// the deployed revision and true instead when the upgrade would not change
+// it, see InstallUpgradeChartWithOptions
+func (h *HelmClient) installUpgradeChart(ctx context.Context, name, chartPath, valuesPath, namespace string, opts InstallOptions, skipUnchanged bool) (rel *release.Release, unchanged bool, err error) {
+	actionConfig, err := h.getHelmActionConfigContext(ctx, namespace)
+	if err != nil {
+		return nil, false, err
+	}
+	// the upgrade modifies actionConfig, a fallback install gets the
+	// configuration as it was
+	installConfig := copyActionConfig(actionConfig)
+	// https://github.com/helm/helm/blob/master/pkg/action/install.go
+	// https://github.com/fluxcd/helm-operator/blob/master/pkg/helm/options.go
+	client := action.NewUpgrade(actionConfig)
+	client.Install = true
+	dryRun := opts.dryRun()
+	client.DryRun = dryRun != ""
+	client.DisableHooks = opts.NoHooks
+	client.Wait = opts.Wait
+	client.Timeout = opts.timeout()
+	if opts.Atomic {
+		client.Atomic = true
+		client.Wait = true
+	}
+	client.Force = opts.Force
+	client.CleanupOnFail = opts.CleanupOnFail
+	client.PostRenderer = opts.PostRenderer
+	client.Description = opts.Description
+	client.SkipCRDs = opts.SkipCRDs
+	client.DisableOpenAPIValidation = opts.DisableOpenAPIValidation
+	client.MaxHistory = opts.historyMax()
+	client.ReuseValues = opts.ReuseValues
+	client.ResetValues = opts.ResetValues
+	if client.ReuseValues && client.ResetValues {
+		return nil, false, errors.New("reuseValues and resetValues are mutually exclusive")
+	}
+
+	emit := noEvents
+	if !client.DryRun {
+		emit = h.newEventEmitter(name, namespace)
+	}
+	// a fallback install reports its own events
+	installed := false
+	defer func() {
+		if installed {
+			return
+		}
+		if err != nil {
+			emit(EventFailed, err)
+			return
+		}
+		emit(EventSucceeded, nil)
+	}()
+	emit(EventLoadingChart, nil)
+
+	localPath, cleanup, err := h.fetchChart(chartPath, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cleanup()
+	if err := h.verifyChart(localPath, opts); err != nil {
+		return nil, false, err
+	}
+	chart, err := h.loadChart(localPath, opts.DependencyUpdate)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := h.isChartInstallable(chart); err != nil {
+		return nil, false, errors.Wrapf(err, "cannot install chart %s", chartPath)
+	}
+
+	vals, err := getValues(valuesPath)
+	if err != nil {
+		h.logger().Error(err, "getvals failed", "vals", vals)
+		return nil, false, err
+	}
+
+	// Add args
+	if err := parseSetValues(opts, vals); err != nil {
+		return nil, false, err
+	}
+
+	waitForJobs := opts.WaitForJobs
+	if waitForJobs && !client.Wait {
+		return nil, false, errors.New("waitForJobs requires wait")
+	}
+
+	if err := checkNotPending(actionConfig, name, namespace); err != nil {
+		return nil, false, err
+	}
+	// forced upgrades and new descriptions must create a revision
+	var deployed *release.Release
+	if skipUnchanged && !client.DryRun && !client.Force && client.Description == "" {
+		last, err := actionConfig.Releases.Last(name)
+		if err == nil && last.Info != nil && last.Info.Status == release.StatusDeployed &&
+			sameChartAndValues(last, chart, upgradeValues(last, vals, client.ReuseValues, client.ResetValues)) {
+			deployed = last
+			client.PostRenderer = unchangedPostRenderer{next: client.PostRenderer, manifest: last.Manifest}
+		}
+	}
+	client.Namespace = namespace
+	h.withEventKubeClient(actionConfig, emit)
+	emit(EventRendering, nil)
+	// the last chance to cancel, helm cannot stop a running upgrade
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	start := time.Now()
+	// https://github.com/helm/helm/blob/master/pkg/release/release.go
+	rel, err = client.Run(name, chart, vals)
+	if deployed != nil && errors.Cause(err) == errUpgradeUnchanged {
+		h.logger().Info("Skipping upgrade without changes", "name", name, "namespace", namespace, "revision", deployed.Version)
+		return deployed, true, nil
+	}
+	if err != nil {
+		err = h.waitError(actionConfig, rel, releaseError(err, name, namespace), name, client.Timeout)
+		h.logger().Error(err, "Failed to upgrade-install helm chart", "name", name, "namespace", namespace)
+		// only a release without deployed revisions gets installed, other
+		// errors, e.g. after an atomic rollback, must not be hidden
+		if !IsNoDeployedReleasesError(err) {
+			return nil, false, err
+		}
+		installed = true
+		var errInstall error
+		if client.DryRun {
+			rel, errInstall = h.installChart(ctx, name, chartPath, []string{valuesPath}, namespace, opts)
+		} else {
+			rel, errInstall = h.installChartWithConfig(ctx, installConfig, name, chartPath, []string{valuesPath}, namespace, opts)
+		}
+		if errInstall != nil {
+			h.logger().Error(errInstall, "Failed to install helm chart", "name", name, "namespace", namespace)
+			return nil, false, errInstall
+		} else {
+			return rel, false, nil
+		}
+	}
+	if dryRun == dryRunServer {
+		if err := h.serverDryRun(actionConfig, rel, !client.DisableOpenAPIValidation); err != nil {
+			return nil, false, err
+		}
+	}
+	if waitForJobs && !client.DryRun {
+		emit(EventWaiting, nil)
+		if err := h.waitForJobs(actionConfig, rel, client.Timeout-time.Since(start)); err != nil {
+			return nil, false, err
+		}
+	}
+	return rel, false, nil
+}
+
+// UninstallChart uninstalls the release.
+//
+// args["noHooks"] skips the pre/post delete hooks, args["keepHistory"] keeps
+// the release revisions so they stay queryable with GetHistory and
+// args["timeout"] bounds the hooks, 5m by default.
+func (h *HelmClient) UninstallChart(name, namespace string, args map[string]interface{}) error {
+	return h.UninstallChartContext(context.Background(), name, namespace, args)
+}
+
+// UninstallChartContext is UninstallChart which returns early when ctx is
+// done. The deadline of ctx caps args["timeout"]. A cancellation once the
+// uninstall is running only stops waiting for it, see runWithContext, so the
+// state of the release is unknown then.
+func (h *HelmClient) UninstallChartContext(ctx context.Context, name, namespace string, args map[string]interface{}) error {
+	args, err := contextArgs(ctx, args)
+	if err != nil {
+		return err
+	}
+	return runWithContext(ctx, func() error {
+		return h.uninstallChart(ctx, name, namespace, args)
+	})
+}
+
+// UninstallMatching uninstalls every release in namespace whose whole name
+// matches regexFilter and returns the names of the uninstalled ones. Unlike
+// ListReleases the filter is anchored at both ends, "web" only matches the
+// release web and not prod-web, use "test-.*" for a prefix. A failing
+// release does not stop the others from being uninstalled, the failures are
+// returned together. keepHistory keeps the revisions like in UninstallChart.
+func (h *HelmClient) UninstallMatching(namespace, regexFilter string, keepHistory bool) ([]string, error) {
+	// an empty filter would list, and so remove, every release
+	if regexFilter == "" {
+		return nil, errors.New("a filter is required to uninstall matching releases")
+	}
+	anchored := "^(?:" + regexFilter + ")$"
+	if _, err := regexp.Compile(anchored); err != nil {
+		return nil, errors.Wrapf(err, "invalid filter %q", regexFilter)
+	}
+	names, err := h.ListReleases(namespace, anchored)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	var errs []error
+	for _, name := range names {
+		if err := h.uninstallChart(context.Background(), name, namespace, map[string]interface{}{"keepHistory": keepHistory}); err != nil {
+			h.logger().Error(err, "Failed to uninstall release", "name", name, "namespace", namespace)
+			errs = append(errs, errors.Wrapf(err, "failed to uninstall release %s", name))
+			continue
+		}
+		removed = append(removed, name)
+	}
+	return removed, utilerrors.NewAggregate(errs)
+}
+
+func (h *HelmClient) uninstallChart(ctx context.Context, name, namespace string, args map[string]interface{}) error {
+	//helm delete $name
+	actionConfig, err := h.getHelmActionConfigContext(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/uninstall.go
+	client := action.NewUninstall(actionConfig)
+	client.DisableHooks = boolArg(args, "noHooks")
+	client.KeepHistory = boolArg(args, "keepHistory")
+	client.Timeout, err = timeoutArg(args)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = client.Run(name)
+	if err != nil {
+		return releaseError(err, name, namespace)
+	}
+	h.logger().Info("Uninstalled release", "name", name)
+	return err
+}
+
+// RollbackRelease rolls back a release to the given revision.
+// A revision of 0 rolls back to the previous revision. The rollback does
+// not wait for the resources, see RollbackReleaseWithOptions.
+func (h *HelmClient) RollbackRelease(name, namespace string, revision int) error {
+	return h.RollbackReleaseContext(context.Background(), name, namespace, revision)
+}
+
+// RollbackReleaseContext is RollbackRelease which returns early when ctx is
+// done. The deadline of ctx bounds the hooks. A cancellation once the
+// rollback is running only stops waiting for it, see runWithContext, so the
+// state of the release is unknown then.
+func (h *HelmClient) RollbackReleaseContext(ctx context.Context, name, namespace string, revision int) error {
+	opts := RollbackOptions{Timeout: contextTimeout(ctx, defaultTimeout)}
+	return runWithContext(ctx, func() error {
+		return h.rollbackRelease(ctx, name, namespace, revision, opts)
+	})
+}
+
+// RollbackReleaseWithOptions is RollbackRelease which optionally waits for
+// the resources of the revision rolled back to. When they do not become
+// ready within opts.Timeout the error is a *ResourcesNotReadyError.
+func (h *HelmClient) RollbackReleaseWithOptions(name, namespace string, revision int, opts RollbackOptions) error {
+	return h.rollbackRelease(context.Background(), name, namespace, revision, opts)
+}
+
+// RollbackToLastDeployed rolls the release back to its newest deployed
+// revision before the latest one, e.g. after a failed upgrade, and returns
+// that revision. It returns ErrNoDeployedReleases without such a revision.
+func (h *HelmClient) RollbackToLastDeployed(name, namespace string) (int, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return 0, err
+	}
+	releases, err := actionConfig.Releases.History(name)
+	if err != nil {
+		return 0, releaseError(err, name, namespace)
+	}
+	if len(releases) == 0 {
+		return 0, errors.Wrapf(ErrReleaseNotFound, "release %s in namespace %s", name, namespace)
+	}
+	releaseutil.Reverse(releases, releaseutil.SortByRevision)
+
+	revision := 0
+	for _, rel := range releases[1:] {
+		if rel.Info != nil && rel.Info.Status == release.StatusDeployed {
+			revision = rel.Version
+			break
+		}
+	}
+	if revision == 0 {
+		return 0, errors.Wrapf(ErrNoDeployedReleases, "release %s in namespace %s has no deployed revision before revision %d", name, namespace, releases[0].Version)
+	}
+	if err := h.rollbackRelease(context.Background(), name, namespace, revision, RollbackOptions{}); err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+func (h *HelmClient) rollbackRelease(ctx context.Context, name, namespace string, revision int, opts RollbackOptions) error {
+	if revision < 0 {
+		return errors.Wrapf(ErrInvalidRevision, "revision %d of release %s", revision, name)
+	}
+	actionConfig, err := h.getHelmActionConfigContext(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/rollback.go
+	if err := checkNotPending(actionConfig, name, namespace); err != nil {
+		return err
+	}
+	if err := checkRevision(actionConfig, name, namespace, revision); err != nil {
+		return err
+	}
+	client := action.NewRollback(actionConfig)
+	client.Version = revision
+	client.Wait = opts.Wait
+	client.Timeout = opts.Timeout
+	if client.Timeout <= 0 {
+		client.Timeout = defaultTimeout
+	}
+	client.CleanupOnFail = opts.CleanupOnFail
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err = client.Run(name)
+	if err != nil {
+		h.logger().Error(err, "Failed to rollback release", "name", name, "namespace", namespace, "revision", revision)
+		if client.Wait {
+			// the revision created by the rollback
+			rel, _ := actionConfig.Releases.Last(name)
+			err = h.waitError(actionConfig, rel, err, name, client.Timeout)
+		}
+		return errors.Wrapf(releaseError(err, name, namespace), "failed to rollback release %s to revision %d", name, revision)
+	}
+	h.logger().Info("Rolled back release", "name", name, "revision", revision)
+	return nil
+}
+
+func (h *HelmClient) isChartInstallable(ch *chart.Chart) (bool, error) {
+	switch ch.Metadata.Type {
+	case "", "application":
+		return true, nil
+	}
+	return false, errors.Errorf("%s charts are not installable", ch.Metadata.Type)
+}
+
+func (h *HelmClient) ListReleases(namespace, regexFilter string) ([]string, error) {
+	var releaseNames []string
+
+	releases, err := h.ListReleasesDetailed(namespace, regexFilter)
+	if err != nil {
+		return []string{}, err
+	}
+
+	for _, release := range releases {
+		releaseNames = append(releaseNames, release.Name)
+	}
+
+	return releaseNames, nil
+}
+
+// ListReleasesDetailed returns name, status and chart details of releases
+func (h *HelmClient) ListReleasesDetailed(namespace, regexFilter string) ([]ReleaseInfo, error) {
+	return h.listReleases(namespace, func(client *action.List) {
+		if len(regexFilter) > 0 {
+			client.Filter = regexFilter
+		}
+	})
+}
+
+// ListReleasesWithOptions is ListReleasesDetailed returning the releases in
+// the order and page given by opts
+func (h *HelmClient) ListReleasesWithOptions(namespace, regexFilter string, opts ListOptions) ([]ReleaseInfo, error) {
+	if opts.Limit < 0 || opts.Offset < 0 {
+		return nil, errors.Errorf("invalid limit %d or offset %d", opts.Limit, opts.Offset)
+	}
+	// helm v3.2 names its date sorters the wrong way round, ByDateDesc
+	// puts the oldest release first
+	var sorter action.Sorter
+	switch opts.SortBy {
+	case "", SortByName:
+		if opts.Descending {
+			sorter = action.ByNameDesc
+		}
+	case SortByDate:
+		sorter = action.ByDateDesc
+		if opts.Descending {
+			sorter = action.ByDateAsc
+		}
+	default:
+		return nil, errors.Errorf("invalid sort %q, must be %q or %q", opts.SortBy, SortByName, SortByDate)
+	}
+	return h.listReleases(namespace, func(client *action.List) {
+		if len(regexFilter) > 0 {
+			client.Filter = regexFilter
+		}
+		client.Limit = opts.Limit
+		client.Offset = opts.Offset
+		client.Sort = sorter
+	})
+}
+
+// ListReleasesByStatus is ListReleasesDetailed limited to releases in one of
+// statuses. Any pending status matches all pending states. An empty statuses
+// lists deployed and failed releases like ListReleasesDetailed.
+func (h *HelmClient) ListReleasesByStatus(namespace, regexFilter string, statuses []release.Status) ([]ReleaseInfo, error) {
+	return h.listReleases(namespace, func(client *action.List) {
+		if len(regexFilter) > 0 {
+			client.Filter = regexFilter
+		}
+		for _, status := range statuses {
+			switch status {
+			case release.StatusDeployed:
+				client.Deployed = true
+			case release.StatusFailed:
+				client.Failed = true
+			case release.StatusPendingInstall, release.StatusPendingUpgrade, release.StatusPendingRollback:
+				client.Pending = true
+			case release.StatusSuperseded:
+				client.Superseded = true
+			case release.StatusUninstalled:
+				client.Uninstalled = true
+			case release.StatusUninstalling:
+				client.Uninstalling = true
+			}
+		}
+		client.SetStateMask()
+	})
+}
+
+// ListAllReleases is ListReleasesDetailed across all namespaces
+func (h *HelmClient) ListAllReleases(regexFilter string) ([]ReleaseInfo, error) {
+	// an empty namespace makes the storage driver look in all namespaces
+	return h.listReleases("", func(client *action.List) {
+		client.AllNamespaces = true
+		if len(regexFilter) > 0 {
+			client.Filter = regexFilter
+		}
+	})
+}
+
+// listReleases runs the list action after setup configured it
+func (h *HelmClient) listReleases(namespace string, setup func(client *action.List)) ([]ReleaseInfo, error) {
+	var releaseInfos []ReleaseInfo
+
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return []ReleaseInfo{}, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/list.go
+	client := action.NewList(actionConfig)
+	setup(client)
+	releases, err := client.Run()
+	if err != nil {
+		return []ReleaseInfo{}, err
+	}
+
+	for _, rel := range releases {
+		releaseInfos = append(releaseInfos, newReleaseInfo(rel))
+	}
+
+	return releaseInfos, nil
+}
+
+func newReleaseResult(rel *release.Release) *ReleaseResult {
+	result := &ReleaseResult{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+		Manifest:  rel.Manifest,
+	}
+	if rel.Info != nil {
+		result.Notes = rel.Info.Notes
+	}
+	return result
+}
+
+func newReleaseInfo(rel *release.Release) ReleaseInfo {
+	info := ReleaseInfo{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+	}
+	if rel.Info != nil {
+		info.Status = rel.Info.Status.String()
+		info.Updated = rel.Info.LastDeployed.Time
+	}
+	if rel.Chart != nil && rel.Chart.Metadata != nil {
+		info.ChartName = rel.Chart.Metadata.Name
+		info.ChartVersion = rel.Chart.Metadata.Version
+		info.AppVersion = rel.Chart.Metadata.AppVersion
+	}
+	return info
+}
+
+// ReleaseExists looks up the latest revision of the release, releases
+// uninstalled with kept history do not exist
+func (h *HelmClient) ReleaseExists(name, namespace string) (bool, error) {
+	exists, _, err := h.ReleaseExistsWithStatus(name, namespace)
+	return exists, err
+}
+
+// ReleaseExistsWithStatus is ReleaseExists which also returns the status of
+// the latest revision, e.g. to wait for a pending-install release rather
+// than reinstalling it. The status is empty when there is no revision at all
+// and uninstalled for releases uninstalled with kept history.
+func (h *HelmClient) ReleaseExistsWithStatus(name, namespace string) (bool, release.Status, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return false, "", err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/status.go
+	client := action.NewStatus(actionConfig)
+	rel, err := client.Run(name)
+	if err != nil {
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	if rel.Info == nil {
+		return true, release.StatusUnknown, nil
+	}
+	return rel.Info.Status != release.StatusUninstalled, rel.Info.Status, nil
+}
+
+// GetReleaseValues returns the user supplied values of a release,
+// or the computed values merged with chart defaults when allValues is set.
+func (h *HelmClient) GetReleaseValues(name, namespace string, allValues bool) (map[string]interface{}, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/get_values.go
+	client := action.NewGetValues(actionConfig)
+	client.AllValues = allValues
+	vals, err := client.Run(name)
+	if err != nil {
+		return nil, releaseError(err, name, namespace)
+	}
+	return vals, nil
+}
+
+// GetHistory returns up to max revisions of a release, 256 when max <= 0
+func (h *HelmClient) GetHistory(name, namespace string, max int) ([]ReleaseRevision, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/history.go
+	client := action.NewHistory(actionConfig)
+	client.Max = max
+	if client.Max <= 0 {
+		client.Max = 256
+	}
+	releases, err := client.Run(name)
+	if err != nil {
+		return nil, releaseError(err, name, namespace)
+	}
+	// helm v3.2 leaves honoring Max to the caller, keep the newest revisions
+	releaseutil.SortByRevision(releases)
+	if len(releases) > client.Max {
+		releases = releases[len(releases)-client.Max:]
+	}
+
+	var revisions []ReleaseRevision
+	for _, rel := range releases {
+		revisions = append(revisions, newReleaseRevision(rel))
+	}
+	return revisions, nil
+}
+
+func newReleaseRevision(rel *release.Release) ReleaseRevision {
+	revision := ReleaseRevision{
+		Revision: rel.Version,
+	}
+	if rel.Info != nil {
+		revision.Status = rel.Info.Status.String()
+		revision.Description = rel.Info.Description
+		revision.Updated = rel.Info.LastDeployed.Time
+	}
+	if rel.Chart != nil && rel.Chart.Metadata != nil {
+		revision.Chart = fmt.Sprintf("%s-%s", rel.Chart.Metadata.Name, rel.Chart.Metadata.Version)
+		revision.AppVersion = rel.Chart.Metadata.AppVersion
+	}
+	return revision
+}
+
+// GetRelease returns the complete stored release revision with its config,
+// manifest, hooks and info, the latest revision when revision is 0
+func (h *HelmClient) GetRelease(name, namespace string, revision int) (*release.Release, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/get.go
+	client := action.NewGet(actionConfig)
+	client.Version = revision
+	rel, err := client.Run(name)
+	if err != nil {
+		return nil, releaseError(err, name, namespace)
+	}
+	return rel, nil
+}
+
+// GetReleaseManifest returns the manifest stored for the release revision,
+// the latest revision when revision is 0
+func (h *HelmClient) GetReleaseManifest(name, namespace string, revision int) (string, error) {
+	rel, err := h.GetRelease(name, namespace, revision)
+	if err != nil {
+		return "", err
+	}
+	return rel.Manifest, nil
+}
+
+// GetReleaseHooks returns the hooks of the latest release revision in the
+// order helm runs them, by weight and then name. When events are given only
+// hooks for at least one of them are returned.
+func (h *HelmClient) GetReleaseHooks(name, namespace string, events ...release.HookEvent) ([]HookInfo, error) {
+	rel, err := h.GetRelease(name, namespace, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]*release.Hook, len(rel.Hooks))
+	copy(hooks, rel.Hooks)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		if hooks[i].Weight != hooks[j].Weight {
+			return hooks[i].Weight < hooks[j].Weight
+		}
+		return hooks[i].Name < hooks[j].Name
+	})
+
+	var hookInfos []HookInfo
+	for _, hook := range hooks {
+		if len(events) > 0 && !hasHookEvent(hook, events) {
+			continue
+		}
+		info := HookInfo{
+			Name:   hook.Name,
+			Kind:   hook.Kind,
+			Weight: hook.Weight,
+		}
+		for _, event := range hook.Events {
+			info.Events = append(info.Events, event.String())
+		}
+		for _, policy := range hook.DeletePolicies {
+			info.DeletePolicies = append(info.DeletePolicies, policy.String())
+		}
+		hookInfos = append(hookInfos, info)
+	}
+	return hookInfos, nil
+}
+
+func hasHookEvent(hook *release.Hook, events []release.HookEvent) bool {
+	for _, event := range hook.Events {
+		for _, want := range events {
+			if event == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetReleaseNotes returns the rendered NOTES.txt stored for the release
+// revision, the latest revision when revision is 0
+func (h *HelmClient) GetReleaseNotes(name, namespace string, revision int) (string, error) {
+	rel, err := h.GetRelease(name, namespace, revision)
+	if err != nil {
+		return "", err
+	}
+	if rel.Info == nil {
+		return "", nil
+	}
+	return rel.Info.Notes, nil
+}
+
+// GetReleaseMetadata returns the chart name and version of the latest
+// release revision, e.g. to tell whether an upgrade to a chart version is
+// needed
+func (h *HelmClient) GetReleaseMetadata(name, namespace string) (*ReleaseMetadata, error) {
+	rel, err := h.GetRelease(name, namespace, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta := &ReleaseMetadata{Revision: rel.Version}
+	if rel.Chart != nil && rel.Chart.Metadata != nil {
+		meta.ChartName = rel.Chart.Metadata.Name
+		meta.ChartVersion = rel.Chart.Metadata.Version
+		meta.AppVersion = rel.Chart.Metadata.AppVersion
+	}
+	return meta, nil
+}
+
+// GetCurrentRevision returns the number of the deployed release revision,
+// which is older than the latest one after a failed upgrade. It returns
+// ErrReleaseNotFound without a release and ErrNoDeployedReleases when no
+// revision is deployed.
+func (h *HelmClient) GetCurrentRevision(name, namespace string) (int, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return 0, err
+	}
+	rel, err := actionConfig.Releases.Deployed(name)
+	if err != nil {
+		// the storage reports missing releases as not deployed
+		if history, errHistory := actionConfig.Releases.History(name); errHistory != nil {
+			err = errHistory
+		} else if len(history) == 0 {
+			err = driver.ErrReleaseNotFound
+		}
+		return 0, releaseError(err, name, namespace)
+	}
+	return rel.Version, nil
+}
+
+// GetReleaseStatus returns the status of the current release revision.
+// With showResources the release manifest resources still present in the
+// cluster are looked up and returned in Resources.
+func (h *HelmClient) GetReleaseStatus(name, namespace string, showResources bool) (*ReleaseStatus, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/status.go
+	client := action.NewStatus(actionConfig)
+	rel, err := client.Run(name)
+	if err != nil {
+		return nil, releaseError(err, name, namespace)
+	}
+
+	status := &ReleaseStatus{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+		Manifest:  rel.Manifest,
+	}
+	if rel.Info != nil {
+		status.Status = rel.Info.Status.String()
+		status.LastDeployed = rel.Info.LastDeployed.Time
+		status.Description = rel.Info.Description
+		status.Notes = rel.Info.Notes
+	}
+	if !showResources {
+		return status, nil
+	}
+
+	resources, err := actionConfig.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build resources of release %s", name)
+	}
+	for _, info := range resources {
+		if err := info.Get(); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to get resource %s of release %s", info.Name, name)
+		}
+		status.Resources = append(status.Resources, fmt.Sprintf("%s/%s", info.Mapping.GroupVersionKind.Kind, info.Name))
+	}
+	return status, nil
+}
+
+// IsReleaseStuck tells whether the latest release revision is pending, i.e.
+// pending-install, pending-upgrade or pending-rollback, since more than
+// olderThan. Such a release blocks upgrades with "another operation is in
+// progress"; a younger one may still be worked on by another client.
+func (h *HelmClient) IsReleaseStuck(name, namespace string, olderThan time.Duration) (bool, error) {
+	rel, err := h.GetRelease(name, namespace, 0)
+	if err != nil {
+		return false, err
+	}
+	if rel.Info == nil || !isPendingStatus(rel.Info.Status) {
+		return false, nil
+	}
+	return time.Since(rel.Info.LastDeployed.Time) > olderThan, nil
+}
+
+// isPendingStatus is release.Status.IsPending of newer helm versions
+func isPendingStatus(status release.Status) bool {
+	return status == release.StatusPendingInstall ||
+		status == release.StatusPendingUpgrade ||
+		status == release.StatusPendingRollback
+}
+
+// ForceUnlock marks the pending latest release revision as failed so that it
+// can be upgraded or rolled back again, e.g. after IsReleaseStuck. Make sure
+// no other client is still working on the release.
+func (h *HelmClient) ForceUnlock(name, namespace string) error {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return err
+	}
+	rel, err := actionConfig.Releases.Last(name)
+	if err != nil {
+		return releaseError(err, name, namespace)
+	}
+	if rel.Info == nil || !isPendingStatus(rel.Info.Status) {
+		return errors.Errorf("release %s in namespace %s is not pending", name, namespace)
+	}
+
+	previous := rel.Info.Status
+	rel.SetStatus(release.StatusFailed, fmt.Sprintf("Unlocked from %s", previous))
+	if err := actionConfig.Releases.Update(rel); err != nil {
+		return errors.Wrapf(err, "failed to unlock release %s", name)
+	}
+	h.logger().Info("Unlocked release", "name", name, "namespace", namespace, "revision", rel.Version, "status", previous)
+	return nil
+}
+
+// WaitForRelease polls the release status every pollInterval until it is
+// desired or ctx is done, in which case ctx.Err() is returned
+func (h *HelmClient) WaitForRelease(ctx context.Context, name, namespace string, desired release.Status, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := h.GetReleaseStatus(name, namespace, false)
+		if err != nil {
+			return err
+		}
+		if status.Status == desired.String() {
+			return nil
+		}
+		h.logger().Info("Waiting for release status", "name", name, "namespace", namespace, "status", status.Status, "desired", desired)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunReleaseTests runs the test hooks of a release like `helm test` and
+// returns the result per test with the test pod logs. The test pods are
+// deleted afterwards when deletePods is set. When a test fails both the
+// result and an error are returned.
+func (h *HelmClient) RunReleaseTests(name, namespace string, timeout time.Duration, deletePods bool) (*TestResult, error) {
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// https://github.com/helm/helm/blob/master/pkg/action/release_testing.go
+	client := action.NewReleaseTesting(actionConfig)
+	client.Namespace = namespace
+	client.Timeout = timeout
+	if client.Timeout <= 0 {
+		client.Timeout = defaultTimeout
+	}
+	rel, runErr := client.Run(name)
+	if rel == nil {
+		return nil, releaseError(runErr, name, namespace)
+	}
+
+	clientSet, err := actionConfig.KubernetesClientSet()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get kubernetes client to fetch test pod logs")
+	}
+	pods := clientSet.CoreV1().Pods(namespace)
+
+	result := &TestResult{Passed: runErr == nil}
+	for _, hook := range rel.Hooks {
+		if !isTestHook(hook) {
+			continue
+		}
+		test := TestHookResult{
+			Name:   hook.Name,
+			Phase:  hook.LastRun.Phase.String(),
+			Passed: hook.LastRun.Phase == release.HookPhaseSucceeded,
+		}
+		if hook.LastRun.Phase != "" && hook.LastRun.Phase != release.HookPhaseUnknown {
+			// pods removed by their hook delete policy have no logs left
+			logs, err := pods.GetLogs(hook.Name, &corev1.PodLogOptions{}).Do(context.Background()).Raw()
+			if err != nil && !apierrors.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "unable to get pod logs for %s", hook.Name)
+			}
+			test.Logs = string(logs)
+		}
+		if deletePods {
+			err := pods.Delete(context.Background(), hook.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "unable to delete test pod %s", hook.Name)
+			}
+		}
+		result.Passed = result.Passed && test.Passed
+		result.Tests = append(result.Tests, test)
+	}
+	if runErr != nil {
+		return result, errors.Wrapf(runErr, "tests of release %s failed", name)
+	}
+	return result, nil
+}
+
+func isTestHook(hook *release.Hook) bool {
+	for _, event := range hook.Events {
+		if event == release.HookTest {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNoDeployedReleasesError tells whether err is caused by a release without
+// deployed revisions, as returned when upgrading a release that does not exist
+func IsNoDeployedReleasesError(err error) bool {
+	return errors.Is(err, driver.ErrNoDeployedReleases)
+}
+
+// releaseError maps the helm errors of well-known failures to
+// ErrReleaseNotFound, ErrReleaseAlreadyExists and ErrInvalidReleaseName
+// with the release name and namespace for context, so that callers can
+// tell them apart with errors.Is. Most helm errors are plain strings, so
+// they are matched by message.
+func releaseError(err error, name, namespace string) error {
+	msg := strings.ToLower(errors.Cause(err).Error())
+	switch {
+	case errors.Is(err, driver.ErrReleaseNotFound):
+		return errors.Wrapf(ErrReleaseNotFound, "release %s in namespace %s", name, namespace)
+	case errors.Is(err, driver.ErrReleaseExists),
+		msg == "cannot re-use a name that is still in use":
+		return errors.Wrapf(ErrReleaseAlreadyExists, "release %s in namespace %s", name, namespace)
+	case strings.Contains(msg, "release name is invalid"),
+		strings.HasPrefix(msg, "invalid release name"),
+		strings.Contains(msg, "exceeds max length"):
+		return errors.Wrapf(ErrInvalidReleaseName, "release %q", name)
+	}
+	return err
+}
+
+// checkRevision returns ErrReleaseNotFound for a missing release and
+// ErrInvalidRevision when the release has no such revision, helm v3.2 reports
+// both as a missing release. A revision of 0 is always valid.
+func checkRevision(actionConfig *action.Configuration, name, namespace string, revision int) error {
+	history, err := actionConfig.Releases.History(name)
+	if err != nil || len(history) == 0 {
+		return errors.Wrapf(ErrReleaseNotFound, "release %s in namespace %s", name, namespace)
+	}
+	if revision == 0 {
+		return nil
+	}
+	for _, rel := range history {
+		if rel.Version == revision {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrInvalidRevision, "release %s in namespace %s has no revision %d", name, namespace, revision)
+}
+
+// checkNotPending returns ErrOperationInProgress when the latest revision of
+// the release is pending. Newer helm versions refuse such upgrades and
+// rollbacks themselves, helm v3.2 would run them concurrently.
+func checkNotPending(actionConfig *action.Configuration, name, namespace string) error {
+	last, err := actionConfig.Releases.Last(name)
+	if err != nil || last.Info == nil || !isPendingStatus(last.Info.Status) {
+		return nil
 	}
-	return false, nil
+	return errors.Wrapf(ErrOperationInProgress, "release %s in namespace %s is %s", name, namespace, last.Info.Status)
 }
@@ -0,0 +1,3061 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	helmtime "helm.sh/helm/v3/pkg/time"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	testChart             = "testdata/mychart"
+	testHookChart         = "testdata/hookchart"
+	testCRDChart          = "testdata/crdchart"
+	testLibChart          = "testdata/librarychart"
+	testJobChart          = "testdata/jobchart"
+	testSchemaChart       = "testdata/schemachart"
+	testCapabilitiesChart = "testdata/capabilitieschart"
+	testValues            = "testdata/novalues.yaml"
+	testNamespace         = "test"
+)
+
+// installTestChart installs testChart as release name into testNamespace
+func installTestChart(t *testing.T, h *HelmClient, name string, args map[string]interface{}) *ReleaseResult {
+	t.Helper()
+	result, err := h.InstallChart(name, testChart, testValues, testNamespace, args)
+	if err != nil {
+		t.Fatalf("failed to install release %s: %v", name, err)
+	}
+	return result
+}
+
+// updateActionConfig changes the cached action configuration of the
+// namespace, its releases are kept
+func updateActionConfig(t *testing.T, h *HelmClient, namespace string, update func(cfg *action.Configuration)) {
+	t.Helper()
+	if _, err := h.getHelmActionConfig(namespace); err != nil {
+		t.Fatal(err)
+	}
+	h.helmMutex.Lock()
+	defer h.helmMutex.Unlock()
+	update(h.actionConfigs[namespace])
+}
+
+// setKubeClient replaces the kube client of the namespace
+func setKubeClient(t *testing.T, h *HelmClient, namespace string, kubeClient kube.Interface) {
+	t.Helper()
+	updateActionConfig(t, h, namespace, func(cfg *action.Configuration) {
+		cfg.KubeClient = kubeClient
+	})
+}
+
+// buildRecordingKubeClient records the manifests it builds resources from
+// and whether they were validated
+type buildRecordingKubeClient struct {
+	kubefake.PrintingKubeClient
+	built     []string
+	validated []bool
+}
+
+func (c *buildRecordingKubeClient) Build(reader io.Reader, validate bool) (kube.ResourceList, error) {
+	manifest, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	c.built = append(c.built, string(manifest))
+	c.validated = append(c.validated, validate)
+	return c.PrintingKubeClient.Build(bytes.NewReader(manifest), validate)
+}
+
+// forceRecordingKubeClient records the force flag of its updates
+type forceRecordingKubeClient struct {
+	kubefake.PrintingKubeClient
+	forced []bool
+}
+
+func (c *forceRecordingKubeClient) Update(original, target kube.ResourceList, force bool) (*kube.Result, error) {
+	c.forced = append(c.forced, force)
+	return c.PrintingKubeClient.Update(original, target, force)
+}
+
+// partialFailureKubeClient fails its creates and updates after creating
+// the created resources, and records the resources it deletes
+type partialFailureKubeClient struct {
+	kubefake.PrintingKubeClient
+	created kube.ResourceList
+	deleted []string
+}
+
+func (c *partialFailureKubeClient) Create(resources kube.ResourceList) (*kube.Result, error) {
+	return &kube.Result{Created: c.created}, errors.New("create failed")
+}
+
+func (c *partialFailureKubeClient) Update(original, target kube.ResourceList, force bool) (*kube.Result, error) {
+	return &kube.Result{Created: c.created}, errors.New("update failed")
+}
+
+func (c *partialFailureKubeClient) Delete(resources kube.ResourceList) (*kube.Result, []error) {
+	for _, info := range resources {
+		c.deleted = append(c.deleted, info.Name)
+	}
+	return c.PrintingKubeClient.Delete(resources)
+}
+
+// jobKubeClient builds the Jobs of unvalidated manifests, as waitForJobs
+// reads them, from the API server at host. The resources applied by the
+// install stay fake.
+type jobKubeClient struct {
+	kubefake.PrintingKubeClient
+	host string
+}
+
+func (c *jobKubeClient) Build(reader io.Reader, validate bool) (kube.ResourceList, error) {
+	if validate {
+		return c.PrintingKubeClient.Build(reader, validate)
+	}
+	manifest, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host:    c.host,
+		APIPath: "/apis",
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &batchv1.SchemeGroupVersion,
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var jobs kube.ResourceList
+	for _, doc := range releaseutil.SplitManifests(string(manifest)) {
+		var head releaseutil.SimpleHead
+		if err := yaml.Unmarshal([]byte(doc), &head); err != nil {
+			return nil, err
+		}
+		if head.Kind == "Job" && head.Metadata != nil {
+			job := &batchv1.Job{}
+			job.APIVersion, job.Kind = "batch/v1", "Job"
+			job.Name, job.Namespace = head.Metadata.Name, testNamespace
+			jobs = append(jobs, &resource.Info{
+				Client:    client,
+				Name:      head.Metadata.Name,
+				Namespace: testNamespace,
+				Object:    job,
+				Mapping: &meta.RESTMapping{
+					Resource:         batchv1.SchemeGroupVersion.WithResource("jobs"),
+					GroupVersionKind: batchv1.SchemeGroupVersion.WithKind("Job"),
+					Scope:            meta.RESTScopeNamespace,
+				},
+			})
+		}
+	}
+	return jobs, nil
+}
+
+// failingDriver fails the release queries with err
+type failingDriver struct {
+	*driver.Memory
+	err error
+}
+
+func (d failingDriver) Query(labels map[string]string) ([]*release.Release, error) {
+	return nil, d.err
+}
+
+// testRESTClientGetter points the kubernetes clients at the API server host
+type testRESTClientGetter struct {
+	host string
+}
+
+func (g testRESTClientGetter) ToRESTConfig() (*rest.Config, error) {
+	return &rest.Config{Host: g.host}, nil
+}
+
+func (g testRESTClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	return nil, errors.New("no discovery in tests")
+}
+
+func (g testRESTClientGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	return nil, errors.New("no rest mapper in tests")
+}
+
+// setReleaseStatus sets the status of the latest revision of the release
+func setReleaseStatus(t *testing.T, h *HelmClient, name, namespace string, status release.Status) {
+	t.Helper()
+	updateReleaseInfo(t, h, name, namespace, func(info *release.Info) {
+		info.Status = status
+	})
+}
+
+// updateReleaseInfo changes the info of the latest release revision
+func updateReleaseInfo(t *testing.T, h *HelmClient, name, namespace string, update func(info *release.Info)) {
+	t.Helper()
+	cfg, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := cfg.Releases.Last(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the driver hands out the stored release, change a copy
+	relCopy := *rel
+	info := *rel.Info
+	update(&info)
+	relCopy.Info = &info
+	if err := cfg.Releases.Update(&relCopy); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flakyKubeClient fails the first updateFailures updates
+type flakyKubeClient struct {
+	kubefake.PrintingKubeClient
+	updateFailures int
+}
+
+func (c *flakyKubeClient) Update(original, target kube.ResourceList, force bool) (*kube.Result, error) {
+	if c.updateFailures > 0 {
+		c.updateFailures--
+		// helm v3.2 reads the created resources of failed updates
+		return &kube.Result{}, errors.New("update failed")
+	}
+	return c.PrintingKubeClient.Update(original, target, force)
+}
+
+// lastRelease returns the latest revision of the release
+func lastRelease(t *testing.T, h *HelmClient, name, namespace string) *release.Release {
+	t.Helper()
+	cfg, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := cfg.Releases.Last(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
+
+func TestInitRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"transient", http.StatusServiceUnavailable, 3, false},
+		{"permanent", http.StatusForbidden, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/version" {
+					http.NotFound(w, r)
+					return
+				}
+				// fails twice then succeeds
+				if atomic.AddInt32(&requests, 1) <= 2 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"major":"1","minor":"18","gitVersion":"v1.18.6"}`)
+			}))
+			defer server.Close()
+			h := newKubeConfigClient(t, server.URL).WithInitRetry(3, time.Minute)
+			// retry right away instead of sleeping
+			h.initBackoff = time.Nanosecond
+
+			_, err := h.getHelmActionConfig(testNamespace)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getHelmActionConfig() = %v, want an error %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&requests); int(got) != tt.wantRequests {
+				t.Errorf("got %d version requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestInitRetryContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	h := newKubeConfigClient(t, server.URL).WithInitRetry(3, time.Hour)
+	h.initBackoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := h.getHelmActionConfigContext(ctx, testNamespace)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+			t.Errorf("getHelmActionConfigContext() = %v, want it to give up with the context", err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("the retries did not end with the context")
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	refused := &url.Error{Op: "Get", URL: "https://kube.example.com/version", Err: &net.OpError{
+		Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{apierrors.NewServiceUnavailable("overloaded"), true},
+		{errors.Wrap(apierrors.NewTooManyRequests("throttled", 1), "failed to reach the cluster"), true},
+		{refused, true},
+		{apierrors.NewForbidden(schema.GroupResource{}, "version", errors.New("no permission")), false},
+		{errors.New("invalid configuration: no server found"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientError(tt.err); got != tt.want {
+			t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// newKubeConfigClient returns a client for the API server at serverURL
+// through a kubeconfig, keeping the releases in memory
+func newKubeConfigClient(t *testing.T, serverURL string) *HelmClient {
+	t.Helper()
+	// the discovery cache lives in $HOME/.kube
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("HELM_DRIVER", "memory")
+	kubeConfig := writeTestFile(t, t.TempDir(), "kubeconfig", `apiVersion: v1
+kind: Config
+clusters:
+  - name: fake
+    cluster:
+      server: `+serverURL+`
+contexts:
+  - name: fake
+    context:
+      cluster: fake
+current-context: fake
+`)
+	h, err := NewHelmClientWithConfig(kubeConfig, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestInstallChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	result := installTestChart(t, h, "web", nil)
+	if result.Name != "web" || result.Namespace != testNamespace || result.Revision != 1 {
+		t.Errorf("got release %s/%s revision %d, want %s/web revision 1", result.Namespace, result.Name, result.Revision, testNamespace)
+	}
+
+	exists, err := h.ReleaseExists("web", testNamespace)
+	if err != nil || !exists {
+		t.Errorf("ReleaseExists() = %v, %v, want true", exists, err)
+	}
+	if _, err := h.InstallChart("web", testChart, testValues, testNamespace, nil); !errors.Is(err, ErrReleaseAlreadyExists) {
+		t.Errorf("installing the release again returned %v, want ErrReleaseAlreadyExists", err)
+	}
+}
+
+func TestInstallChartResult(t *testing.T) {
+	h := NewHelmClientForTesting()
+	result := installTestChart(t, h, "web", map[string]interface{}{"set": "service.port=8080"})
+
+	const notes = "web is listening on port 8080."
+	if strings.TrimSpace(result.Notes) != notes {
+		t.Errorf("got notes %q, want %q", result.Notes, notes)
+	}
+	stored, err := h.GetReleaseNotes("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != result.Notes {
+		t.Errorf("got stored notes %q, want %q", stored, result.Notes)
+	}
+	if !strings.Contains(result.Manifest, "port: 8080") {
+		t.Errorf("manifest has no port 8080:\n%s", result.Manifest)
+	}
+}
+
+// labelPostRenderer adds the team label to the top level labels of the
+// manifests
+type labelPostRenderer struct{}
+
+func (labelPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	manifests := strings.ReplaceAll(renderedManifests.String(), "\n  labels:\n", "\n  labels:\n    team: platform\n")
+	return bytes.NewBufferString(manifests), nil
+}
+
+func TestInstallChartPostRenderer(t *testing.T) {
+	h := NewHelmClientForTesting()
+	args := map[string]interface{}{"postRenderer": labelPostRenderer{}}
+	result := installTestChart(t, h, "web", args)
+	if !strings.Contains(result.Manifest, "team: platform") {
+		t.Errorf("installed manifest has no team label:\n%s", result.Manifest)
+	}
+
+	args["set"] = "replicaCount=2"
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := h.GetReleaseManifest("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(manifest, "team: platform") {
+		t.Errorf("upgraded manifest has no team label:\n%s", manifest)
+	}
+}
+
+func TestInstallChartSkipCRDs(t *testing.T) {
+	const crdKind = "kind: CustomResourceDefinition"
+	h := NewHelmClientForTesting()
+	kubeClient := &buildRecordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}}
+	setKubeClient(t, h, testNamespace, kubeClient)
+
+	if _, err := h.InstallChart("skipped", testCRDChart, testValues, testNamespace, map[string]interface{}{"skipCRDs": true}); err != nil {
+		t.Fatal(err)
+	}
+	if built := strings.Join(kubeClient.built, "\n---\n"); strings.Contains(built, crdKind) {
+		t.Errorf("install with skipCRDs applied the CRD:\n%s", built)
+	}
+	kubeClient.built = nil
+	if _, err := h.InstallChart("applied", testCRDChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	if built := strings.Join(kubeClient.built, "\n---\n"); !strings.Contains(built, crdKind) {
+		t.Errorf("install without skipCRDs did not apply the CRD:\n%s", built)
+	}
+
+	manifest, err := h.RenderTemplate("web", testCRDChart, testValues, testNamespace, map[string]interface{}{"includeCRDs": true, "skipCRDs": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(manifest, crdKind) {
+		t.Errorf("rendered manifest with skipCRDs has the CRD:\n%s", manifest)
+	}
+}
+
+func TestDisableOpenAPIValidation(t *testing.T) {
+	h := NewHelmClientForTesting()
+	kubeClient := &buildRecordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}}
+	setKubeClient(t, h, testNamespace, kubeClient)
+
+	tests := []struct {
+		name         string
+		upgrade      bool
+		args         map[string]interface{}
+		wantValidate bool
+	}{
+		{"validated", false, nil, true},
+		{"validated", true, map[string]interface{}{"set": "replicaCount=2"}, true},
+		{"unvalidated", false, map[string]interface{}{"disableOpenAPIValidation": true}, false},
+		{"unvalidated", true, map[string]interface{}{"disableOpenAPIValidation": true, "set": "replicaCount=2"}, false},
+	}
+	for _, tt := range tests {
+		kubeClient.validated = nil
+		var err error
+		if tt.upgrade {
+			_, err = h.InstallUpgradeChart(tt.name, testChart, testValues, testNamespace, tt.args)
+		} else {
+			_, err = h.InstallChart(tt.name, testChart, testValues, testNamespace, tt.args)
+		}
+		if err != nil {
+			t.Fatalf("failed to install or upgrade %s: %v", tt.name, err)
+		}
+		// upgrades build the current resources unvalidated either way
+		validated := false
+		for _, validate := range kubeClient.validated {
+			validated = validated || validate
+		}
+		if validated != tt.wantValidate {
+			t.Errorf("%s (upgrade %v) validated resources %v, want %v", tt.name, tt.upgrade, validated, tt.wantValidate)
+		}
+	}
+}
+
+func TestInstallChartCreateNamespace(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tests := []struct {
+		namespace string
+		upgrade   bool
+	}{
+		{"fresh", false},
+		{"fresh-upgrade", true},
+	}
+	for _, tt := range tests {
+		kubeClient := &buildRecordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}}
+		setKubeClient(t, h, tt.namespace, kubeClient)
+		args := map[string]interface{}{"createNamespace": true}
+		var err error
+		if tt.upgrade {
+			_, err = h.InstallUpgradeChart("web", testChart, testValues, tt.namespace, args)
+		} else {
+			_, err = h.InstallChart("web", testChart, testValues, tt.namespace, args)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		created := false
+		for _, manifest := range kubeClient.built {
+			if strings.Contains(manifest, "kind: Namespace") && strings.Contains(manifest, "name: "+tt.namespace+"\n") {
+				created = true
+			}
+		}
+		if !created {
+			t.Errorf("namespace %s was not created (upgrade %v), built %q", tt.namespace, tt.upgrade, kubeClient.built)
+		}
+	}
+}
+
+func TestInstallChartGenerateName(t *testing.T) {
+	h := NewHelmClientForTesting()
+	result, err := h.InstallChart("", testChart, testValues, testNamespace, map[string]interface{}{"generateName": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.Name, "mychart-") {
+		t.Errorf("got generated name %q, want one starting with mychart-", result.Name)
+	}
+	exists, err := h.ReleaseExists(result.Name, testNamespace)
+	if err != nil || !exists {
+		t.Errorf("ReleaseExists(%s) = %v, %v, want true", result.Name, exists, err)
+	}
+}
+
+func TestInstallChartNameTemplate(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tenant := "acme"
+	result, err := h.InstallChart("", testChart, testValues, testNamespace, map[string]interface{}{
+		"nameTemplate": `{{ printf "tenant-%s" "` + tenant + `" }}-{{ randAlpha 4 | lower }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.Name, "tenant-acme-") || len(result.Name) != len("tenant-acme-")+4 {
+		t.Errorf("got release name %q, want tenant-acme- and 4 letters", result.Name)
+	}
+	exists, err := h.ReleaseExists(result.Name, testNamespace)
+	if err != nil || !exists {
+		t.Errorf("ReleaseExists(%s) = %v, %v, want true", result.Name, exists, err)
+	}
+
+	if _, err := h.InstallChart("web", testChart, testValues, testNamespace, map[string]interface{}{"nameTemplate": "tenant"}); err == nil {
+		t.Error("installing with a name and a name template succeeded")
+	}
+}
+
+func TestInstallLibraryChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	const want = "cannot install chart " + testLibChart + ": library charts are not installable"
+	if _, err := h.InstallChart("web", testLibChart, testValues, testNamespace, nil); err == nil || err.Error() != want {
+		t.Errorf("installing a library chart returned %v, want %q", err, want)
+	}
+	if _, err := h.InstallUpgradeChart("web", testLibChart, testValues, testNamespace, nil); err == nil || err.Error() != want {
+		t.Errorf("upgrading to a library chart returned %v, want %q", err, want)
+	}
+}
+
+func TestInstallChartMulti(t *testing.T) {
+	h := NewHelmClientForTesting()
+	dir := t.TempDir()
+	base := writeTestFile(t, dir, "base.yaml", "image:\n  repository: example.com/nginx\n  tag: \"1.19\"\nreplicaCount: 2\n")
+	override := writeTestFile(t, dir, "override.yaml", "image:\n  tag: \"1.20\"\n")
+
+	if _, err := h.InstallChartMulti("web", testChart, []string{base, override}, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := h.GetReleaseValues("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"image.tag":        "1.20",
+		"image.repository": "example.com/nginx",
+		"replicaCount":     "2",
+	}
+	for path, value := range want {
+		if got := fmt.Sprint(valueAt(vals, path)); got != value {
+			t.Errorf("got %s %s, want %s", path, got, value)
+		}
+	}
+}
+
+func TestReleaseExists(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	exists, err := h.ReleaseExists("web", testNamespace)
+	if err != nil || !exists {
+		t.Errorf("ReleaseExists(web) = %v, %v, want true", exists, err)
+	}
+	exists, err = h.ReleaseExists("missing", testNamespace)
+	if err != nil || exists {
+		t.Errorf("ReleaseExists(missing) = %v, %v, want false", exists, err)
+	}
+
+	errAPI := errors.New("the server is currently unable to handle the request")
+	updateActionConfig(t, h, testNamespace, func(cfg *action.Configuration) {
+		cfg.Releases = storage.Init(failingDriver{Memory: driver.NewMemory(), err: errAPI})
+	})
+	if _, err := h.ReleaseExists("web", testNamespace); !errors.Is(err, errAPI) {
+		t.Errorf("ReleaseExists() returned %v on an API error, want %v", err, errAPI)
+	}
+}
+
+func TestInstallChartDependencyUpdate(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	parent := newParentChart(t)
+
+	if _, err := h.InstallChart("web", parent, testValues, testNamespace, nil); err == nil {
+		t.Fatal("installing without the dependencies succeeded")
+	}
+	result, err := h.InstallChart("web", parent, testValues, testNamespace, map[string]interface{}{"dependencyUpdate": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"kind: ConfigMap", "kind: Deployment"} {
+		if !strings.Contains(result.Manifest, kind) {
+			t.Errorf("manifest has no %s:\n%s", kind, result.Manifest)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "charts", "mychart-0.1.0.tgz")); err != nil {
+		t.Errorf("the dependency was not downloaded: %v", err)
+	}
+}
+
+func TestInstallChartSubchartValues(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	parent := newParentChart(t)
+	args := map[string]interface{}{
+		"dependencyUpdate": true,
+		"set":              "mychart.replicaCount=4",
+		"setMap":           map[string]string{"mychart.image.tag": "1.21,debug"},
+	}
+	result, err := h.InstallChart("web", parent, testValues, testNamespace, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"replicas: 4", `image: "nginx:1.21,debug"`} {
+		if !strings.Contains(result.Manifest, want) {
+			t.Errorf("subchart manifest has no %q:\n%s", want, result.Manifest)
+		}
+	}
+
+	vals, err := h.GetReleaseValues("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"mychart": map[string]interface{}{
+			"replicaCount": int64(4),
+			"image":        map[string]interface{}{"tag": "1.21,debug"},
+		},
+	}
+	if fmt.Sprint(vals) != fmt.Sprint(want) {
+		t.Errorf("got user supplied values %v, want them under the subchart key %v", vals, want)
+	}
+}
+
+func TestInstallChartFromRepoVersionConstraint(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	server := newTestRepo(t, "", "", "0.1.0", "0.1.5", "0.2.0", "1.0.0")
+
+	tests := []struct {
+		constraint string
+		want       string
+	}{
+		{"~0.1.0", "0.1.5"},
+		{">=0.1.0 <1.0.0", "0.2.0"},
+		{"", "1.0.0"},
+	}
+	for i, tt := range tests {
+		name := fmt.Sprintf("web-%d", i)
+		result, err := h.InstallChartFromRepo(name, server.URL, "mychart", tt.constraint, testValues, testNamespace, nil)
+		if err != nil {
+			t.Fatalf("failed to install version %q: %v", tt.constraint, err)
+		}
+		if version := lastRelease(t, h, result.Name, testNamespace).Chart.Metadata.Version; version != tt.want {
+			t.Errorf("version %q installed chart %s, want %s", tt.constraint, version, tt.want)
+		}
+	}
+
+	if _, err := h.InstallChartFromRepo("web", server.URL, "mychart", "^2.0.0", testValues, testNamespace, nil); err == nil {
+		t.Error("installing a version no chart satisfies succeeded")
+	}
+}
+
+func TestInstallChartVerify(t *testing.T) {
+	h := NewHelmClientForTesting()
+	dir := t.TempDir()
+	archivePath, err := h.PackageChart(testChart, dir, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := signTestChart(t, archivePath)
+	args := map[string]interface{}{"verify": true, "keyring": keyring}
+
+	if _, err := h.InstallChart("signed", archivePath, testValues, testNamespace, args); err != nil {
+		t.Fatalf("installing the signed chart failed: %v", err)
+	}
+
+	// same name and version, different content
+	if _, err := h.PackageChart(testChart, dir, "", "2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.InstallChart("tampered", archivePath, testValues, testNamespace, args); err == nil || !strings.Contains(err.Error(), "failed to verify") {
+		t.Errorf("installing the tampered chart returned %v, want a verify error", err)
+	}
+	if exists, _ := h.ReleaseExists("tampered", testNamespace); exists {
+		t.Error("the tampered chart was installed")
+	}
+}
+
+func TestInstallUpgradeChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	// installs the release without one
+	result, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Revision != 1 {
+		t.Errorf("got revision %d after the install, want 1", result.Revision)
+	}
+
+	result, err = h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "image.tag=1.20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Revision != 2 {
+		t.Errorf("got revision %d after the upgrade, want 2", result.Revision)
+	}
+	vals, err := h.GetReleaseValues("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag := valueAt(vals, "image.tag"); tag != "1.20" {
+		t.Errorf("got image.tag %v, want 1.20", tag)
+	}
+}
+
+func TestInstallChartDryRun(t *testing.T) {
+	h := NewHelmClientForTesting()
+	dryRun := map[string]interface{}{"dryRun": true}
+
+	result, err := h.InstallChart("web", testChart, testValues, testNamespace, dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Manifest, "kind: Deployment") {
+		t.Errorf("dry run manifest has no Deployment:\n%s", result.Manifest)
+	}
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, dryRun); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := h.ReleaseExists("web", testNamespace)
+	if err != nil || exists {
+		t.Errorf("ReleaseExists() = %v, %v after the dry runs, want false", exists, err)
+	}
+
+	installTestChart(t, h, "web", nil)
+	upgradeDryRun := map[string]interface{}{"dryRun": true, "set": "replicaCount=2"}
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, upgradeDryRun); err != nil {
+		t.Fatal(err)
+	}
+	if rel := lastRelease(t, h, "web", testNamespace); rel.Version != 1 {
+		t.Errorf("got revision %d after the upgrade dry run, want 1", rel.Version)
+	}
+}
+
+func TestInstallUpgradeChartAtomic(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	setKubeClient(t, h, testNamespace, &flakyKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+		updateFailures:     1,
+	})
+
+	args := map[string]interface{}{"atomic": true, "set": "replicaCount=3"}
+	_, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args)
+	if err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("failed atomic upgrade returned %v, want a rollback error", err)
+	}
+
+	history, err := h.GetHistory("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, revision := range history {
+		statuses = append(statuses, revision.Status)
+	}
+	if want := []string{"superseded", "failed", "deployed"}; !equalStrings(statuses, want) {
+		t.Errorf("got revision statuses %v, want %v", statuses, want)
+	}
+	if rel := lastRelease(t, h, "web", testNamespace); rel.Config["replicaCount"] != nil {
+		t.Errorf("release kept the values of the failed upgrade: %v", rel.Config)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		valsPath  string
+		want      map[string]interface{}
+		wantError bool
+	}{
+		{"no file", "", map[string]interface{}{}, false},
+		{"missing file", filepath.Join(dir, "missing.yaml"), nil, true},
+		{"empty file", writeTestFile(t, dir, "empty.yaml", ""), map[string]interface{}{}, false},
+		{"values", writeTestFile(t, dir, "values.yaml", "image:\n  tag: \"1.20\"\n"), map[string]interface{}{"image": map[string]interface{}{"tag": "1.20"}}, false},
+	}
+	for _, tt := range tests {
+		got, err := getValues(tt.valsPath)
+		if (err != nil) != tt.wantError {
+			t.Errorf("%s: getValues() error = %v, want an error %v", tt.name, err, tt.wantError)
+			continue
+		}
+		if !tt.wantError && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: getValues() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// an empty path installs with the chart defaults
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallChart("missing", testChart, filepath.Join(dir, "missing.yaml"), testNamespace, nil); err == nil {
+		t.Error("installing with a missing values file succeeded")
+	}
+}
+
+// parseArgValues merges the set args into vals like InstallChart does
+func parseArgValues(args map[string]interface{}, vals map[string]interface{}) error {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return err
+	}
+	return parseSetValues(opts, vals)
+}
+
+func TestParseArgValuesSetString(t *testing.T) {
+	vals := map[string]interface{}{}
+	args := map[string]interface{}{
+		"set":       "replicaCount=2,debug=true",
+		"setString": "image.tag=01234,enabled=true",
+	}
+	if err := parseArgValues(args, vals); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"replicaCount": int64(2),
+		"debug":        true,
+		"image.tag":    "01234",
+		"enabled":      "true",
+	}
+	for path, value := range want {
+		if got := valueAt(vals, path); got != value {
+			t.Errorf("got %s %#v, want %#v", path, got, value)
+		}
+	}
+
+	for _, key := range []string{"set", "setString"} {
+		err := parseArgValues(map[string]interface{}{key: 1234}, map[string]interface{}{})
+		if err == nil || !strings.Contains(err.Error(), key+" must be a string") {
+			t.Errorf("a non-string %s returned %v", key, err)
+		}
+	}
+}
+
+func TestParseArgValuesSetJSON(t *testing.T) {
+	vals := map[string]interface{}{
+		"image": map[string]interface{}{"repository": "nginx", "tag": "1.19"},
+		"hosts": []interface{}{"a.example.com", "b.example.com"},
+	}
+	args := map[string]interface{}{
+		"setJSON": `{"image": {"tag": "1.20", "pullPolicy": "Always"}, "hosts": ["c.example.com"]}`,
+	}
+	if err := parseArgValues(args, vals); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"image.repository": "nginx",
+		"image.tag":        "1.20",
+		"image.pullPolicy": "Always",
+		// arrays are replaced, not merged
+		"hosts": "[c.example.com]",
+	}
+	for path, value := range want {
+		if got := fmt.Sprint(valueAt(vals, path)); got != value {
+			t.Errorf("got %s %s, want %s", path, got, value)
+		}
+	}
+
+	// --set is applied after the JSON values
+	vals = map[string]interface{}{}
+	args = map[string]interface{}{"setJSON": `{"replicaCount": 2}`, "set": "replicaCount=3"}
+	if err := parseArgValues(args, vals); err != nil {
+		t.Fatal(err)
+	}
+	if replicas := fmt.Sprint(vals["replicaCount"]); replicas != "3" {
+		t.Errorf("got replicaCount %s, want the --set 3", replicas)
+	}
+
+	if err := parseArgValues(map[string]interface{}{"setJSON": `{"image":`}, map[string]interface{}{}); err == nil {
+		t.Error("invalid JSON returned no error")
+	}
+	if err := parseArgValues(map[string]interface{}{"setJSON": map[string]interface{}{}}, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "setJSON must be a string") {
+		t.Errorf("a non-string setJSON returned %v", err)
+	}
+}
+
+func TestParseArgValuesSetMap(t *testing.T) {
+	vals := map[string]interface{}{}
+	args := map[string]interface{}{
+		"setMap": map[string]string{
+			"ingress.hosts": "a.example.com,b.example.com",
+			"path":          `C:\charts`,
+			"image.tag":     "1.20",
+		},
+	}
+	if err := parseArgValues(args, vals); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"ingress.hosts": "a.example.com,b.example.com",
+		"path":          `C:\charts`,
+		"image.tag":     "1.20",
+	}
+	for path, value := range want {
+		if got := valueAt(vals, path); got != value {
+			t.Errorf("got %s %#v, want %q", path, got, value)
+		}
+	}
+
+	if err := parseArgValues(map[string]interface{}{"setMap": map[string]interface{}{"a": "b"}}, map[string]interface{}{}); err == nil {
+		t.Error("a setMap that is not a map[string]string returned no error")
+	}
+}
+
+func TestParseArgValuesSetFile(t *testing.T) {
+	const cert = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	certPath := writeTestFile(t, t.TempDir(), "tls.crt", cert)
+
+	vals := map[string]interface{}{}
+	if err := parseArgValues(map[string]interface{}{"setFile": "tls.cert=" + certPath}, vals); err != nil {
+		t.Fatal(err)
+	}
+	if got := valueAt(vals, "tls.cert"); got != cert {
+		t.Errorf("got tls.cert %q, want %q", got, cert)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.crt")
+	if err := parseArgValues(map[string]interface{}{"setFile": "tls.cert=" + missing}, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("a missing file returned %v, want an error naming it", err)
+	}
+	if err := parseArgValues(map[string]interface{}{"setFile": []string{"tls.cert=" + certPath}}, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "setFile must be a string") {
+		t.Errorf("a non-string setFile returned %v", err)
+	}
+}
+
+func TestInstallUpgradeChartUnchanged(t *testing.T) {
+	h := NewHelmClientForTesting()
+	args := map[string]interface{}{"set": "replicaCount=2"}
+	first, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Unchanged {
+		t.Error("first install reports no change")
+	}
+
+	second, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Unchanged || second.Revision != 1 {
+		t.Errorf("repeated install got revision %d, unchanged %v, want revision 1 unchanged", second.Revision, second.Unchanged)
+	}
+
+	third, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Unchanged || third.Revision != 2 {
+		t.Errorf("upgrade with new values got revision %d, unchanged %v, want revision 2 changed", third.Revision, third.Unchanged)
+	}
+
+	// forced upgrades and new descriptions are never skipped
+	for i, args := range []map[string]interface{}{
+		{"set": "replicaCount=3", "force": true},
+		{"set": "replicaCount=3", "description": "rotate the pods"},
+	} {
+		result, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 3 + i; result.Unchanged || result.Revision != want {
+			t.Errorf("upgrade with %v got revision %d, unchanged %v, want revision %d changed", args, result.Revision, result.Unchanged, want)
+		}
+	}
+}
+
+// countingPostRenderer counts the manifests it is run on
+type countingPostRenderer struct {
+	runs *int32
+}
+
+func (p countingPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	atomic.AddInt32(p.runs, 1)
+	return renderedManifests, nil
+}
+
+func TestInstallUpgradeChartRendersOnce(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	for _, tt := range []struct {
+		set       string
+		unchanged bool
+	}{
+		{"replicaCount=2", false},
+		{"replicaCount=2", true},
+	} {
+		var runs int32
+		args := map[string]interface{}{"set": tt.set, "postRenderer": countingPostRenderer{&runs}}
+		result, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Unchanged != tt.unchanged {
+			t.Errorf("upgrade got unchanged %v, want %v", result.Unchanged, tt.unchanged)
+		}
+		if runs != 1 {
+			t.Errorf("upgrade with unchanged %v rendered the manifest %d times, want once", tt.unchanged, runs)
+		}
+	}
+}
+
+func TestInstallUpgradeChartHistoryMax(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		want int
+	}{
+		{"default", nil, defaultHistoryMax},
+		// nil is unset like for the other args, not unlimited
+		{"nil", map[string]interface{}{"historyMax": nil}, defaultHistoryMax},
+		{"capped", map[string]interface{}{"historyMax": 3}, 3},
+		{"unlimited", map[string]interface{}{"historyMax": 0}, defaultHistoryMax + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHelmClientForTesting()
+			for i := 0; i < defaultHistoryMax+2; i++ {
+				args := map[string]interface{}{"set": fmt.Sprintf("replicaCount=%d", i+1)}
+				for key, val := range tt.args {
+					args[key] = val
+				}
+				if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+					t.Fatal(err)
+				}
+			}
+			history, err := h.GetHistory("web", testNamespace, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != tt.want {
+				t.Errorf("got %d revisions, want %d", len(history), tt.want)
+			}
+			if latest := history[len(history)-1].Revision; latest != defaultHistoryMax+2 {
+				t.Errorf("got latest revision %d, want %d", latest, defaultHistoryMax+2)
+			}
+		})
+	}
+}
+
+func TestInstallUpgradeChartForce(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		t.Run(fmt.Sprint(force), func(t *testing.T) {
+			h := NewHelmClientForTesting()
+			installTestChart(t, h, "web", nil)
+			kubeClient := &forceRecordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}}
+			setKubeClient(t, h, testNamespace, kubeClient)
+
+			args := map[string]interface{}{"set": "replicaCount=2", "force": force}
+			if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+				t.Fatal(err)
+			}
+			if len(kubeClient.forced) != 1 || kubeClient.forced[0] != force {
+				t.Errorf("got updates with force %v, want one with force %v", kubeClient.forced, force)
+			}
+		})
+	}
+}
+
+func TestInstallUpgradeChartCleanupOnFail(t *testing.T) {
+	newKubeClient := func() *partialFailureKubeClient {
+		return &partialFailureKubeClient{
+			PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+			created:            kube.ResourceList{{Name: "web-orphan", Namespace: testNamespace}},
+		}
+	}
+
+	t.Run("upgrade", func(t *testing.T) {
+		for _, cleanupOnFail := range []bool{false, true} {
+			h := NewHelmClientForTesting()
+			installTestChart(t, h, "web", nil)
+			kubeClient := newKubeClient()
+			setKubeClient(t, h, testNamespace, kubeClient)
+			args := map[string]interface{}{"set": "replicaCount=2", "cleanupOnFail": cleanupOnFail}
+			if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err == nil {
+				t.Fatal("expected the upgrade to fail")
+			}
+			var want []string
+			if cleanupOnFail {
+				want = []string{"web-orphan"}
+			}
+			if !equalStrings(kubeClient.deleted, want) {
+				t.Errorf("cleanupOnFail %v deleted %v, want %v", cleanupOnFail, kubeClient.deleted, want)
+			}
+		}
+	})
+
+	t.Run("install", func(t *testing.T) {
+		// helm annotates the resources of the release, not the hooks
+		newInfo := func(name string, annotations map[string]string) *resource.Info {
+			obj := &unstructured.Unstructured{}
+			obj.SetName(name)
+			obj.SetAnnotations(annotations)
+			return &resource.Info{Name: name, Namespace: testNamespace, Object: obj}
+		}
+		for _, cleanupOnFail := range []bool{false, true} {
+			h := NewHelmClientForTesting()
+			kubeClient := newKubeClient()
+			kubeClient.created = kube.ResourceList{
+				newInfo("web-orphan", map[string]string{"meta.helm.sh/release-name": "web"}),
+				newInfo("web-hook", map[string]string{"helm.sh/hook": "pre-install"}),
+			}
+			setKubeClient(t, h, testNamespace, kubeClient)
+			args := map[string]interface{}{"cleanupOnFail": cleanupOnFail}
+			// the fake builds no resources, creating the hooks fails
+			if _, err := h.InstallChart("web", testHookChart, testValues, testNamespace, args); err == nil {
+				t.Fatal("expected the install to fail")
+			}
+			var want []string
+			if cleanupOnFail {
+				want = []string{"web-orphan"}
+			}
+			if !equalStrings(kubeClient.deleted, want) {
+				t.Errorf("cleanupOnFail %v deleted %v, want %v", cleanupOnFail, kubeClient.deleted, want)
+			}
+			// the failed release is kept either way
+			if status, err := h.GetReleaseStatus("web", testNamespace, false); err != nil || status.Status != release.StatusFailed.String() {
+				t.Errorf("cleanupOnFail %v: got release status %+v, %v after the failed install, want failed", cleanupOnFail, status, err)
+			}
+		}
+	})
+}
+
+func TestInstallChartWaitForJobs(t *testing.T) {
+	const jobPath = "/apis/batch/v1/namespaces/" + testNamespace + "/jobs/web-migrate"
+	tests := []struct {
+		name      string
+		condition batchv1.JobConditionType
+		wantErr   bool
+	}{
+		{"complete", batchv1.JobComplete, false},
+		{"failed", batchv1.JobFailed, true},
+		{"running", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			gets := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != jobPath {
+					http.NotFound(w, r)
+					return
+				}
+				mu.Lock()
+				gets++
+				mu.Unlock()
+				job := batchv1.Job{}
+				job.APIVersion, job.Kind, job.Name = "batch/v1", "Job", "web-migrate"
+				if tt.condition != "" {
+					job.Status.Conditions = []batchv1.JobCondition{{Type: tt.condition, Status: "True"}}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(job); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer server.Close()
+
+			h := NewHelmClientForTesting()
+			updateActionConfig(t, h, testNamespace, func(cfg *action.Configuration) {
+				cfg.KubeClient = &jobKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}, host: server.URL}
+				cfg.RESTClientGetter = testRESTClientGetter{host: server.URL}
+			})
+			args := map[string]interface{}{"wait": true, "waitForJobs": true, "timeout": "1s"}
+			_, err := h.InstallChart("web", testJobChart, testValues, testNamespace, args)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if gets == 0 {
+				t.Error("the install did not wait for the job")
+			}
+		})
+	}
+
+	h := NewHelmClientForTesting()
+	if _, err := h.InstallChart("web", testJobChart, testValues, testNamespace, map[string]interface{}{"waitForJobs": true}); err == nil {
+		t.Error("waitForJobs without wait succeeded")
+	}
+}
+
+func TestInstallChartServerDryRun(t *testing.T) {
+	const jobsPath = "/apis/batch/v1/namespaces/" + testNamespace + "/jobs"
+	tests := []struct {
+		name    string
+		dryRun  string
+		status  int
+		wantErr bool
+		wantReq []string
+	}{
+		{"client", "client", http.StatusCreated, false, nil},
+		{"server accepts", "server", http.StatusCreated, false, []string{"POST " + jobsPath + "?dryRun=All"}},
+		{"server rejects", "server", http.StatusUnprocessableEntity, true, []string{"POST " + jobsPath + "?dryRun=All"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					// the install checks that the job does not exist yet
+					http.NotFound(w, r)
+					return
+				}
+				mu.Lock()
+				requests = append(requests, r.Method+" "+r.URL.RequestURI())
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				if tt.status != http.StatusCreated {
+					fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Invalid","message":"rejected by admission","code":422}`)
+					return
+				}
+				if _, err := io.Copy(w, r.Body); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer server.Close()
+
+			h := NewHelmClientForTesting()
+			setKubeClient(t, h, testNamespace, &jobKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}, host: server.URL})
+			// jobKubeClient only builds unvalidated manifests
+			args := map[string]interface{}{"dryRun": tt.dryRun, "disableOpenAPIValidation": true}
+			_, err := h.InstallChart("web", testJobChart, testValues, testNamespace, args)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !equalStrings(requests, tt.wantReq) {
+				t.Errorf("got API requests %v, want %v", requests, tt.wantReq)
+			}
+			if exists, err := h.ReleaseExists("web", testNamespace); err != nil || exists {
+				t.Errorf("dry run stored the release: %v, %v", exists, err)
+			}
+		})
+	}
+}
+
+func TestInstallUpgradeChartNoHooks(t *testing.T) {
+	// a chart with a post-install and a post-upgrade hook
+	chartDir := filepath.Join(t.TempDir(), "upgradehookchart")
+	if err := os.MkdirAll(filepath.Join(chartDir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, chartDir, "Chart.yaml", "apiVersion: v2\nname: upgradehookchart\nversion: 0.1.0\n")
+	writeTestFile(t, chartDir, "templates/configmap.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  greeting: {{ .Values.greeting | default "hello" }}
+`)
+	for _, event := range []string{"post-install", "post-upgrade"} {
+		writeTestFile(t, chartDir, "templates/"+event+".yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-`+event+`
+  annotations:
+    "helm.sh/hook": `+event+"\n")
+	}
+
+	for _, noHooks := range []bool{false, true} {
+		h := NewHelmClientForTesting()
+		kubeClient := &buildRecordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}}
+		setKubeClient(t, h, testNamespace, kubeClient)
+		builtHook := func(name string) bool {
+			for _, manifest := range kubeClient.built {
+				if strings.Contains(manifest, "name: "+name) {
+					return true
+				}
+			}
+			return false
+		}
+
+		args := map[string]interface{}{"noHooks": noHooks}
+		if _, err := h.InstallChart("web", chartDir, testValues, testNamespace, args); err != nil {
+			t.Fatal(err)
+		}
+		if built := builtHook("web-post-install"); built == noHooks {
+			t.Errorf("install with noHooks %v created the post-install hook: %v", noHooks, built)
+		}
+		args["set"] = "greeting=hi"
+		if _, err := h.InstallUpgradeChart("web", chartDir, testValues, testNamespace, args); err != nil {
+			t.Fatal(err)
+		}
+		if built := builtHook("web-post-upgrade"); built == noHooks {
+			t.Errorf("upgrade with noHooks %v created the post-upgrade hook: %v", noHooks, built)
+		}
+	}
+}
+
+func TestInstallUpgradeChartReuseValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    map[string]interface{}
+		wantTag interface{}
+	}{
+		{"reuse", map[string]interface{}{"reuseValues": true}, "1.20"},
+		{"reset", map[string]interface{}{"resetValues": true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHelmClientForTesting()
+			installTestChart(t, h, "web", map[string]interface{}{"set": "image.tag=1.20"})
+
+			tt.args["set"] = "replicaCount=3"
+			if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, tt.args); err != nil {
+				t.Fatal(err)
+			}
+			vals, err := h.GetReleaseValues("web", testNamespace, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag := valueAt(vals, "image.tag"); tag != tt.wantTag {
+				t.Errorf("got image.tag %v, want %v", tag, tt.wantTag)
+			}
+			if replicas := fmt.Sprint(valueAt(vals, "replicaCount")); replicas != "3" {
+				t.Errorf("got replicaCount %s, want 3", replicas)
+			}
+		})
+	}
+
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	both := map[string]interface{}{"reuseValues": true, "resetValues": true, "set": "replicaCount=3"}
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, both); err == nil {
+		t.Error("reusing and resetting the values succeeded")
+	}
+}
+
+func TestIsNoDeployedReleasesError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrNoDeployedReleases, true},
+		{errors.Wrap(driver.ErrNoDeployedReleases, `"web" has no deployed releases`), true},
+		{ErrReleaseNotFound, false},
+		{errors.New("has no deployed releases"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsNoDeployedReleasesError(tt.err); got != tt.want {
+			t.Errorf("IsNoDeployedReleasesError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestInstallUpgradeChartFallback(t *testing.T) {
+	h := NewHelmClientForTesting()
+	// no deployed revision, the upgrade falls back to an install
+	result, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, nil)
+	if err != nil || result.Revision != 1 {
+		t.Fatalf("InstallUpgradeChart() = %+v, %v, want revision 1", result, err)
+	}
+
+	// other upgrade errors are returned as is
+	setKubeClient(t, h, testNamespace, &flakyKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+		updateFailures:     1,
+	})
+	_, err = h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"})
+	if err == nil || !strings.Contains(err.Error(), "update failed") {
+		t.Errorf("failed upgrade returned %v, want the update error", err)
+	}
+	history, err := h.GetHistory("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].Status != "failed" {
+		t.Errorf("got history %+v, want the failed upgrade without a reinstall", history)
+	}
+}
+
+func TestInstallUpgradeChartFallbackConfig(t *testing.T) {
+	h := NewHelmClientForTesting()
+	calls := 0
+	h.initConfig = func(namespace string) (*action.Configuration, error) {
+		calls++
+		return h.newTestingActionConfig(namespace), nil
+	}
+	// drop the cached configuration once the upgrade has its own, a fallback
+	// install getting a new one would initialize it again
+	invalidated := false
+	h.WithEventHook(func(event HelmEvent) {
+		if !invalidated {
+			invalidated = true
+			h.InvalidateConfigCache(testNamespace)
+		}
+	})
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !invalidated {
+		t.Fatal("the upgrade reported no events")
+	}
+	if calls != 1 {
+		t.Errorf("the upgrade and its fallback install initialized %d configurations, want 1", calls)
+	}
+	if exists, err := h.ReleaseExists("web", testNamespace); err != nil || !exists {
+		t.Errorf("ReleaseExists() = %v, %v after the fallback install, want true", exists, err)
+	}
+}
+
+func TestReleaseErrors(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	installTestChart(t, h, "pending", nil)
+	if _, err := h.InstallUpgradeChart("pending", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"}); err != nil {
+		t.Fatal(err)
+	}
+	setReleaseStatus(t, h, "pending", testNamespace, release.StatusPendingUpgrade)
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"install existing", func() error {
+			_, err := h.InstallChart("web", testChart, testValues, testNamespace, nil)
+			return err
+		}, ErrReleaseAlreadyExists},
+		{"install invalid name", func() error {
+			_, err := h.InstallChart("Web_Release!", testChart, testValues, testNamespace, nil)
+			return err
+		}, ErrInvalidReleaseName},
+		{"install long name", func() error {
+			_, err := h.InstallChart(strings.Repeat("a", 54), testChart, testValues, testNamespace, nil)
+			return err
+		}, ErrInvalidReleaseName},
+		{"upgrade pending", func() error {
+			_, err := h.InstallUpgradeChart("pending", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=3"})
+			return err
+		}, ErrOperationInProgress},
+		{"rollback pending", func() error {
+			return h.RollbackRelease("pending", testNamespace, 1)
+		}, ErrOperationInProgress},
+		{"get missing", func() error {
+			_, err := h.GetRelease("missing", testNamespace, 0)
+			return err
+		}, ErrReleaseNotFound},
+		{"uninstall missing", func() error {
+			return h.UninstallChart("missing", testNamespace, nil)
+		}, ErrReleaseNotFound},
+		{"rollback missing", func() error {
+			return h.RollbackRelease("missing", testNamespace, 1)
+		}, ErrReleaseNotFound},
+		{"rollback missing revision", func() error {
+			return h.RollbackRelease("web", testNamespace, 7)
+		}, ErrInvalidRevision},
+		{"rollback negative revision", func() error {
+			return h.RollbackRelease("web", testNamespace, -1)
+		}, ErrInvalidRevision},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUninstallChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	if err := h.UninstallChart("web", testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := h.ReleaseExists("web", testNamespace)
+	if err != nil || exists {
+		t.Errorf("ReleaseExists() = %v, %v after the uninstall, want false", exists, err)
+	}
+	if err := h.UninstallChart("web", testNamespace, nil); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("uninstalling the release again returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestUninstallChartKeepHistory(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	if err := h.UninstallChart("web", testNamespace, map[string]interface{}{"keepHistory": true, "timeout": "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := h.GetHistory("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Status != "uninstalled" {
+		t.Errorf("got history %+v, want the uninstalled revision 1", history)
+	}
+	exists, err := h.ReleaseExists("web", testNamespace)
+	if err != nil || exists {
+		t.Errorf("ReleaseExists() = %v, %v after the uninstall, want false", exists, err)
+	}
+}
+
+func TestUninstallMatching(t *testing.T) {
+	h := NewHelmClientForTesting()
+	for _, name := range []string{"test-api", "test-web", "prod-web"} {
+		installTestChart(t, h, name, nil)
+	}
+
+	// the filter matches whole names only
+	if removed, err := h.UninstallMatching(testNamespace, "web", true); err != nil || len(removed) != 0 {
+		t.Errorf("UninstallMatching() = %v, %v for a partial name, want none removed", removed, err)
+	}
+	removed, err := h.UninstallMatching(testNamespace, "test-.*", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removed)
+	if want := []string{"test-api", "test-web"}; !equalStrings(removed, want) {
+		t.Errorf("UninstallMatching() removed %v, want %v", removed, want)
+	}
+	names, err := h.ListReleases(testNamespace, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"prod-web"}; !equalStrings(names, want) {
+		t.Errorf("releases left %v, want %v", names, want)
+	}
+	// keepHistory keeps the uninstalled revisions
+	if history, err := h.GetHistory("test-api", testNamespace, 0); err != nil || len(history) != 1 {
+		t.Errorf("GetHistory() = %+v, %v after uninstalling with keepHistory, want one revision", history, err)
+	}
+
+	if removed, err := h.UninstallMatching(testNamespace, "test-.*", false); err != nil || len(removed) != 0 {
+		t.Errorf("UninstallMatching() = %v, %v without matches, want none removed", removed, err)
+	}
+	if _, err := h.UninstallMatching(testNamespace, "", false); err == nil {
+		t.Error("expected an empty filter to fail")
+	}
+}
+
+func TestListReleases(t *testing.T) {
+	h := NewHelmClientForTesting()
+	for _, name := range []string{"web", "api", "worker"} {
+		installTestChart(t, h, name, nil)
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"api", "web", "worker"}},
+		{"^w", []string{"web", "worker"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		names, err := h.ListReleases(testNamespace, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("ListReleases(%q) = %v, want %v", tt.filter, names, tt.want)
+		}
+	}
+}
+
+func TestListReleasesDetailed(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	infos, err := h.ListReleasesDetailed(testNamespace, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("got releases %v, want 1", infos)
+	}
+	info := infos[0]
+	want := ReleaseInfo{
+		Name:         "web",
+		Namespace:    testNamespace,
+		Revision:     1,
+		Status:       "deployed",
+		ChartName:    "mychart",
+		ChartVersion: "0.1.0",
+		AppVersion:   "1.0.0",
+		Updated:      info.Updated,
+	}
+	if info != want {
+		t.Errorf("got release %+v, want %+v", info, want)
+	}
+	if info.Updated.IsZero() {
+		t.Error("got a zero Updated time")
+	}
+}
+
+func TestListReleasesWithOptionsPaging(t *testing.T) {
+	h := NewHelmClientForTesting()
+	for _, name := range []string{"e", "c", "a", "d", "b"} {
+		installTestChart(t, h, name, nil)
+	}
+	tests := []struct {
+		limit, offset int
+		want          []string
+	}{
+		{0, 0, []string{"a", "b", "c", "d", "e"}},
+		{2, 0, []string{"a", "b"}},
+		{2, 2, []string{"c", "d"}},
+		{2, 4, []string{"e"}},
+		{0, 3, []string{"d", "e"}},
+		{2, 5, nil},
+	}
+	for _, tt := range tests {
+		infos, err := h.ListReleasesWithOptions(testNamespace, "", ListOptions{Limit: tt.limit, Offset: tt.offset})
+		if err != nil {
+			t.Fatalf("limit %d, offset %d: %v", tt.limit, tt.offset, err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("limit %d, offset %d listed %v, want %v", tt.limit, tt.offset, names, tt.want)
+		}
+	}
+
+	if _, err := h.ListReleasesWithOptions(testNamespace, "", ListOptions{Limit: -1}); err == nil {
+		t.Error("expected a negative limit to fail")
+	}
+}
+
+func TestListReleasesWithOptionsSort(t *testing.T) {
+	h := NewHelmClientForTesting()
+	deployed := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// b was deployed first, then c, then a
+	for i, name := range []string{"b", "c", "a"} {
+		installTestChart(t, h, name, nil)
+		updateReleaseInfo(t, h, name, testNamespace, func(info *release.Info) {
+			info.LastDeployed = helmtime.Time{Time: deployed.Add(time.Duration(i) * time.Hour)}
+		})
+	}
+	tests := []struct {
+		opts ListOptions
+		want []string
+	}{
+		{ListOptions{}, []string{"a", "b", "c"}},
+		{ListOptions{Descending: true}, []string{"c", "b", "a"}},
+		{ListOptions{SortBy: SortByDate}, []string{"b", "c", "a"}},
+		{ListOptions{SortBy: SortByDate, Descending: true}, []string{"a", "c", "b"}},
+		{ListOptions{SortBy: SortByDate, Limit: 2}, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		infos, err := h.ListReleasesWithOptions(testNamespace, "", tt.opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.opts, err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("%+v listed %v, want %v", tt.opts, names, tt.want)
+		}
+	}
+
+	if _, err := h.ListReleasesWithOptions(testNamespace, "", ListOptions{SortBy: "size"}); err == nil {
+		t.Error("expected an unknown sort to fail")
+	}
+}
+
+func TestGetReleaseValues(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", map[string]interface{}{"set": "image.tag=1.20"})
+
+	vals, err := h.GetReleaseValues("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag := valueAt(vals, "image.tag"); tag != "1.20" {
+		t.Errorf("got image.tag %v, want 1.20", tag)
+	}
+	if repository := valueAt(vals, "image.repository"); repository != nil {
+		t.Errorf("got chart default image.repository %v in the user values", repository)
+	}
+
+	all, err := h.GetReleaseValues("web", testNamespace, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, repository := valueAt(all, "image.tag"), valueAt(all, "image.repository"); tag != "1.20" || repository != "nginx" {
+		t.Errorf("got image %v:%v in all values, want nginx:1.20", repository, tag)
+	}
+	if _, err := h.GetReleaseValues("missing", testNamespace, false); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("reading the values of a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestListReleasesByStatus(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	installTestChart(t, h, "broken", nil)
+	setKubeClient(t, h, testNamespace, &flakyKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+		updateFailures:     1,
+	})
+	if _, err := h.InstallUpgradeChart("broken", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"}); err == nil {
+		t.Fatal("the failing upgrade succeeded")
+	}
+
+	tests := []struct {
+		statuses []release.Status
+		want     []string
+	}{
+		{nil, []string{"broken", "web"}},
+		{[]release.Status{release.StatusFailed}, []string{"broken"}},
+		// the failed upgrade leaves revision 1 of broken deployed
+		{[]release.Status{release.StatusDeployed}, []string{"broken", "web"}},
+		{[]release.Status{release.StatusPendingInstall}, nil},
+	}
+	for _, tt := range tests {
+		infos, err := h.ListReleasesByStatus(testNamespace, "", tt.statuses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("ListReleasesByStatus(%v) = %v, want %v", tt.statuses, names, tt.want)
+		}
+	}
+}
+
+func TestListAllReleases(t *testing.T) {
+	h := NewHelmClientForTesting()
+	for _, namespace := range []string{"alpha", "beta"} {
+		if _, err := h.InstallChart("web", testChart, testValues, namespace, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.InstallChart("api", testChart, testValues, "beta", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := h.ListAllReleases("^web$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var releases []string
+	for _, info := range infos {
+		releases = append(releases, info.Namespace+"/"+info.Name)
+	}
+	sort.Strings(releases)
+	if want := []string{"alpha/web", "beta/web"}; !equalStrings(releases, want) {
+		t.Errorf("ListAllReleases() = %v, want %v", releases, want)
+	}
+}
+
+func TestReleaseDescription(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", map[string]interface{}{"description": "deploy abc123"})
+	upgrades := []map[string]interface{}{
+		{"description": "deploy def456", "set": "replicaCount=2"},
+		{"set": "replicaCount=3"},
+	}
+	for _, args := range upgrades {
+		if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := h.GetHistory("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descriptions []string
+	for _, revision := range history {
+		descriptions = append(descriptions, revision.Description)
+	}
+	// helm describes revisions without a description itself
+	if want := []string{"deploy abc123", "deploy def456", "Upgrade complete"}; !equalStrings(descriptions, want) {
+		t.Errorf("got descriptions %q, want %q", descriptions, want)
+	}
+}
+
+func TestReleaseExistsWithStatus(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "deployed", nil)
+	installTestChart(t, h, "failed", nil)
+	setReleaseStatus(t, h, "failed", testNamespace, release.StatusFailed)
+	installTestChart(t, h, "pending", nil)
+	setReleaseStatus(t, h, "pending", testNamespace, release.StatusPendingInstall)
+
+	tests := []struct {
+		name       string
+		wantExists bool
+		wantStatus release.Status
+	}{
+		{"deployed", true, release.StatusDeployed},
+		{"failed", true, release.StatusFailed},
+		{"pending", true, release.StatusPendingInstall},
+		{"missing", false, ""},
+	}
+	for _, tt := range tests {
+		exists, status, err := h.ReleaseExistsWithStatus(tt.name, testNamespace)
+		if err != nil {
+			t.Fatalf("ReleaseExistsWithStatus(%s) failed: %v", tt.name, err)
+		}
+		if exists != tt.wantExists || status != tt.wantStatus {
+			t.Errorf("ReleaseExistsWithStatus(%s) = %v, %q, want %v, %q", tt.name, exists, status, tt.wantExists, tt.wantStatus)
+		}
+	}
+}
+
+func TestGetRelease(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ revision, want int }{{0, 2}, {1, 1}, {2, 2}} {
+		rel, err := h.GetRelease("web", testNamespace, tt.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rel.Name != "web" || rel.Namespace != testNamespace || rel.Version != tt.want {
+			t.Errorf("GetRelease(%d) = %s/%s revision %d, want %s/web revision %d", tt.revision, rel.Namespace, rel.Name, rel.Version, testNamespace, tt.want)
+		}
+		if rel.Chart == nil || rel.Info == nil || rel.Manifest == "" {
+			t.Errorf("GetRelease(%d) has no chart, info or manifest", tt.revision)
+		}
+	}
+	if _, err := h.GetRelease("web", testNamespace, 3); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("reading a missing revision returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestGetCurrentRevision(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	for want := 1; want <= 3; want++ {
+		if want > 1 {
+			args := map[string]interface{}{"set": fmt.Sprintf("replicaCount=%d", want)}
+			if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if revision, err := h.GetCurrentRevision("web", testNamespace); err != nil || revision != want {
+			t.Errorf("GetCurrentRevision() = %d, %v, want %d", revision, err, want)
+		}
+	}
+
+	// a failed upgrade leaves the previous revision deployed
+	setKubeClient(t, h, testNamespace, &kubefake.FailingKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+		UpdateError:        errors.New("update failed"),
+	})
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=4"}); err == nil {
+		t.Fatal("the failing upgrade returned no error")
+	}
+	if revision, err := h.GetCurrentRevision("web", testNamespace); err != nil || revision != 3 {
+		t.Errorf("GetCurrentRevision() = %d, %v after the failed upgrade, want 3", revision, err)
+	}
+
+	installTestChart(t, h, "failed", nil)
+	setReleaseStatus(t, h, "failed", testNamespace, release.StatusFailed)
+	if _, err := h.GetCurrentRevision("failed", testNamespace); !errors.Is(err, ErrNoDeployedReleases) {
+		t.Errorf("GetCurrentRevision() of a failed release returned %v, want ErrNoDeployedReleases", err)
+	}
+	if _, err := h.GetCurrentRevision("missing", testNamespace); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("GetCurrentRevision() of a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestGetReleaseMetadata(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	meta, err := h.GetReleaseMetadata("web", testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReleaseMetadata{ChartName: "mychart", ChartVersion: "0.1.0", AppVersion: "1.0.0", Revision: 1}
+	if *meta != want {
+		t.Errorf("GetReleaseMetadata() = %+v, want %+v", *meta, want)
+	}
+
+	archive, err := h.PackageChart(testChart, t.TempDir(), "0.2.0", "1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.InstallUpgradeChart("web", archive, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = h.GetReleaseMetadata("web", testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ReleaseMetadata{ChartName: "mychart", ChartVersion: "0.2.0", AppVersion: "1.1.0", Revision: 2}
+	if *meta != want {
+		t.Errorf("GetReleaseMetadata() = %+v after upgrading the chart, want %+v", *meta, want)
+	}
+
+	if _, err := h.GetReleaseMetadata("missing", testNamespace); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("got error %v for a missing release, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestGetReleaseManifest(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		revision int
+		replicas string
+	}{
+		{0, "replicas: 2"},
+		{1, "replicas: 1"},
+	}
+	for _, tt := range tests {
+		manifest, err := h.GetReleaseManifest("web", testNamespace, tt.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"kind: Deployment", "kind: Service", "name: web", tt.replicas} {
+			if !strings.Contains(manifest, want) {
+				t.Errorf("manifest of revision %d has no %q:\n%s", tt.revision, want, manifest)
+			}
+		}
+	}
+	if _, err := h.GetReleaseManifest("missing", testNamespace, 0); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("reading the manifest of a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestGetReleaseNotes(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", map[string]interface{}{"set": "service.port=8080"})
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "service.port=9090"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		revision int
+		want     string
+	}{
+		{0, "web is listening on port 9090."},
+		{1, "web is listening on port 8080."},
+	}
+	for _, tt := range tests {
+		notes, err := h.GetReleaseNotes("web", testNamespace, tt.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(notes) != tt.want {
+			t.Errorf("GetReleaseNotes(%d) = %q, want %q", tt.revision, notes, tt.want)
+		}
+	}
+	if _, err := h.GetReleaseNotes("missing", testNamespace, 0); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("reading the notes of a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestGetReleaseHooks(t *testing.T) {
+	h := NewHelmClientForTesting()
+	if _, err := h.InstallChart("web", testHookChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	postInstall := HookInfo{
+		Name:           "web-post-install",
+		Kind:           "Job",
+		Events:         []string{"post-install"},
+		Weight:         5,
+		DeletePolicies: []string{"hook-succeeded"},
+	}
+	test := HookInfo{Name: "web-test-greeting", Kind: "Pod", Events: []string{"test"}}
+
+	tests := []struct {
+		events []release.HookEvent
+		want   []HookInfo
+	}{
+		// by weight
+		{nil, []HookInfo{test, postInstall}},
+		{[]release.HookEvent{release.HookPostInstall}, []HookInfo{postInstall}},
+		{[]release.HookEvent{release.HookPreDelete}, nil},
+	}
+	for _, tt := range tests {
+		hooks, err := h.GetReleaseHooks("web", testNamespace, tt.events...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hooks, tt.want) {
+			t.Errorf("GetReleaseHooks(%v) = %+v, want %+v", tt.events, hooks, tt.want)
+		}
+	}
+}
+
+func TestRollbackRelease(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.RollbackRelease("web", testNamespace, 1); err != nil {
+		t.Fatal(err)
+	}
+	rel := lastRelease(t, h, "web", testNamespace)
+	if rel.Version != 3 {
+		t.Errorf("got revision %d after the rollback, want 3", rel.Version)
+	}
+	if _, ok := rel.Config["replicaCount"]; ok {
+		t.Errorf("rollback to revision 1 kept the values of revision 2: %v", rel.Config)
+	}
+	if err := h.RollbackRelease("missing", testNamespace, 0); err == nil {
+		t.Error("rolling back a missing release returned no error")
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	h := NewHelmClientForTesting()
+	if _, err := h.InstallChartContext(context.Background(), "web", testChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, errUpgrade := h.InstallUpgradeChartContext(ctx, "web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"})
+	errs := map[string]error{
+		"upgrade":   errUpgrade,
+		"uninstall": h.UninstallChartContext(ctx, "web", testNamespace, nil),
+		"rollback":  h.RollbackReleaseContext(ctx, "web", testNamespace, 0),
+	}
+	for op, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with a canceled context returned %v, want context.Canceled", op, err)
+		}
+	}
+	if rel := lastRelease(t, h, "web", testNamespace); rel.Version != 1 || rel.Info.Status != release.StatusDeployed {
+		t.Errorf("got revision %d %s after the canceled operations, want the deployed revision 1", rel.Version, rel.Info.Status)
+	}
+}
+
+func TestContextCanceledBeforeRun(t *testing.T) {
+	h := NewHelmClientForTesting()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel once the chart is loaded, while the caller is already waiting
+	done := make(chan HelmEvent, 1)
+	h.WithEventHook(func(event HelmEvent) {
+		switch event.Stage {
+		case EventRendering:
+			cancel()
+		case EventSucceeded, EventFailed:
+			done <- event
+		}
+	})
+
+	if _, err := h.InstallChartContext(ctx, "web", testChart, testValues, testNamespace, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled install returned %v, want context.Canceled", err)
+	}
+	select {
+	case event := <-done:
+		if event.Stage != EventFailed || !errors.Is(event.Err, context.Canceled) {
+			t.Errorf("the install ended with %s %v, want it failed by the cancellation", event.Stage, event.Err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("the install did not end")
+	}
+	if exists, err := h.ReleaseExists("web", testNamespace); err != nil || exists {
+		t.Errorf("ReleaseExists() = %v, %v after the canceled install, want false", exists, err)
+	}
+}
+
+// waitTimeoutKubeClient records the timeout of its last wait
+type waitTimeoutKubeClient struct {
+	kubefake.PrintingKubeClient
+	timeout time.Duration
+}
+
+func (c *waitTimeoutKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
+	c.timeout = timeout
+	return nil
+}
+
+func TestContextDeadline(t *testing.T) {
+	h := NewHelmClientForTesting()
+	kubeClient := &waitTimeoutKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}}
+	setKubeClient(t, h, testNamespace, kubeClient)
+	args := map[string]interface{}{"wait": true, "timeout": "1h"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := h.InstallChartContext(ctx, "web", testChart, testValues, testNamespace, args); err != nil {
+		t.Fatal(err)
+	}
+	if kubeClient.timeout <= 0 || kubeClient.timeout > time.Minute {
+		t.Errorf("install waited up to %s, want the minute left of the context", kubeClient.timeout)
+	}
+	if args["timeout"] != "1h" {
+		t.Errorf("got args timeout %v, want the args unchanged", args["timeout"])
+	}
+
+	if _, err := h.InstallUpgradeChartContext(context.Background(), "web", testChart, testValues, testNamespace, map[string]interface{}{"wait": true, "timeout": "1h", "set": "replicaCount=2"}); err != nil {
+		t.Fatal(err)
+	}
+	if kubeClient.timeout != time.Hour {
+		t.Errorf("upgrade without a deadline waited up to %s, want 1h", kubeClient.timeout)
+	}
+}
+
+func TestRollbackToLastDeployed(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"}); err != nil {
+		t.Fatal(err)
+	}
+	setKubeClient(t, h, testNamespace, &kubefake.FailingKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+		UpdateError:        errors.New("update failed"),
+	})
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=3"}); err == nil {
+		t.Fatal("the failing upgrade returned no error")
+	}
+	setKubeClient(t, h, testNamespace, &kubefake.PrintingKubeClient{Out: io.Discard})
+
+	revision, err := h.RollbackToLastDeployed("web", testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 2 {
+		t.Errorf("RollbackToLastDeployed() chose revision %d, want 2", revision)
+	}
+	rel, err := h.GetRelease("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 4 || rel.Info.Status != release.StatusDeployed || fmt.Sprint(rel.Config["replicaCount"]) != "2" {
+		t.Errorf("got revision %d %s with values %v after the rollback, want revision 4 deployed with replicaCount 2", rel.Version, rel.Info.Status, rel.Config)
+	}
+
+	// the latest revision is the only deployed one
+	if _, err := h.RollbackToLastDeployed("web", testNamespace); !errors.Is(err, ErrNoDeployedReleases) {
+		t.Errorf("rolling back without an earlier deployed revision returned %v, want ErrNoDeployedReleases", err)
+	}
+	installTestChart(t, h, "failed", nil)
+	setReleaseStatus(t, h, "failed", testNamespace, release.StatusFailed)
+	if _, err := h.RollbackToLastDeployed("failed", testNamespace); !errors.Is(err, ErrNoDeployedReleases) {
+		t.Errorf("rolling back a failed install returned %v, want ErrNoDeployedReleases", err)
+	}
+	if _, err := h.RollbackToLastDeployed("missing", testNamespace); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("rolling back a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tests := []struct {
+		name      string
+		chartPath string
+		args      map[string]interface{}
+		want      []string
+		notWant   []string
+	}{
+		{"resources", testChart, nil, []string{"kind: Deployment", "kind: Service"}, nil},
+		{"without hooks", testHookChart, nil, []string{"kind: ConfigMap"}, []string{"kind: Job", "kind: Pod"}},
+		{"with hooks", testHookChart, map[string]interface{}{"includeHooks": true}, []string{"kind: ConfigMap", "kind: Job", "kind: Pod"}, nil},
+		{"without crds", testCRDChart, nil, []string{"kind: CronTab"}, []string{"kind: CustomResourceDefinition"}},
+		{"with crds", testCRDChart, map[string]interface{}{"includeCRDs": true}, []string{"kind: CronTab", "kind: CustomResourceDefinition"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := h.RenderTemplate("web", tt.chartPath, testValues, testNamespace, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, kind := range tt.want {
+				if !strings.Contains(manifest, kind) {
+					t.Errorf("manifest has no %s:\n%s", kind, manifest)
+				}
+			}
+			for _, kind := range tt.notWant {
+				if strings.Contains(manifest, kind) {
+					t.Errorf("manifest has %s:\n%s", kind, manifest)
+				}
+			}
+		})
+	}
+	if exists, err := h.ReleaseExists("web", testNamespace); err != nil || exists {
+		t.Errorf("ReleaseExists() = %v, %v after rendering, want false", exists, err)
+	}
+}
+
+func TestRenderTemplateFiles(t *testing.T) {
+	h := NewHelmClientForTesting()
+	files, err := h.RenderTemplateFiles(testChart, testValues, []string{"templates/deployment.yaml"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.Contains(files["templates/deployment.yaml"], "kind: Deployment") {
+		t.Errorf("got rendered files %v, want only templates/deployment.yaml", files)
+	}
+
+	files, err = h.RenderTemplateFiles(testChart, testValues, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if want := []string{"templates/deployment.yaml", "templates/service.yaml"}; !equalStrings(paths, want) {
+		t.Errorf("got rendered files %v without showOnly, want %v", paths, want)
+	}
+
+	files, err = h.RenderTemplateFiles(testChart, testValues, []string{"templates/s*.yaml"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["templates/service.yaml"] == "" {
+		t.Errorf("got rendered files %v for a glob, want only templates/service.yaml", files)
+	}
+
+	if _, err := h.RenderTemplateFiles(testChart, testValues, []string{"templates/missing.yaml"}, nil); err == nil {
+		t.Error("expected a missing template to fail")
+	}
+}
+
+func TestRenderTemplateKubeVersion(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tests := []struct {
+		kubeVersion string
+		want        []string
+	}{
+		// helm's default capabilities
+		{"", []string{"apiVersion: networking.k8s.io/v1beta1", `kube-minor: "16"`}},
+		{"v1.18.2", []string{"apiVersion: networking.k8s.io/v1beta1", `kube-minor: "18"`}},
+		{"v1.20.0", []string{"apiVersion: networking.k8s.io/v1\n", `kube-minor: "20"`}},
+	}
+	for _, tt := range tests {
+		args := map[string]interface{}{}
+		if tt.kubeVersion != "" {
+			args["kubeVersion"] = tt.kubeVersion
+		}
+		manifest, err := h.RenderTemplate("web", testCapabilitiesChart, testValues, testNamespace, args)
+		if err != nil {
+			t.Fatalf("kubeVersion %q: %v", tt.kubeVersion, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(manifest, want) {
+				t.Errorf("kubeVersion %q rendered %q, want it to contain %q", tt.kubeVersion, manifest, want)
+			}
+		}
+	}
+
+	if _, err := h.RenderTemplate("web", testCapabilitiesChart, testValues, testNamespace, map[string]interface{}{"kubeVersion": "latest"}); err == nil {
+		t.Error("expected an invalid kubeVersion to fail")
+	}
+}
+
+func TestRenderTemplateAPIVersions(t *testing.T) {
+	h := NewHelmClientForTesting()
+	tests := []struct {
+		apiVersions interface{}
+		want        string
+	}{
+		{nil, "apiVersion: policy/v1beta1"},
+		{[]string{"policy/v1"}, "apiVersion: policy/v1\n"},
+	}
+	for _, tt := range tests {
+		files, err := h.RenderTemplateFiles(testCapabilitiesChart, testValues, []string{"templates/poddisruptionbudget.yaml"},
+			map[string]interface{}{"apiVersions": tt.apiVersions})
+		if err != nil {
+			t.Fatalf("apiVersions %v: %v", tt.apiVersions, err)
+		}
+		if got := files["templates/poddisruptionbudget.yaml"]; !strings.Contains(got, tt.want) {
+			t.Errorf("apiVersions %v rendered %q, want it to contain %q", tt.apiVersions, got, tt.want)
+		}
+	}
+
+	if _, err := h.RenderTemplate("web", testCapabilitiesChart, testValues, testNamespace, map[string]interface{}{"apiVersions": "policy/v1"}); err == nil {
+		t.Error("expected apiVersions that are not a []string to fail")
+	}
+}
+
+func TestNewHelmClientWithConfig(t *testing.T) {
+	kubeConfig := writeTestFile(t, t.TempDir(), "kubeconfig", `apiVersion: v1
+kind: Config
+clusters:
+  - name: dev
+    cluster:
+      server: https://dev.example.com
+users:
+  - name: dev
+    user:
+      token: secret
+contexts:
+  - name: dev
+    context:
+      cluster: dev
+      user: dev
+current-context: dev
+`)
+
+	if _, err := NewHelmClientWithConfig(kubeConfig, "dev"); err != nil {
+		t.Errorf("NewHelmClientWithConfig() with an existing context returned %v", err)
+	}
+	_, err := NewHelmClientWithConfig(kubeConfig, "prod")
+	if err == nil || !strings.Contains(err.Error(), `context "prod" does not exist`) {
+		t.Errorf("NewHelmClientWithConfig() with an invalid context returned %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := NewHelmClientWithConfig(missing, ""); err == nil {
+		t.Error("NewHelmClientWithConfig() with a missing kubeconfig returned no error")
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	h := NewHelmClientForTesting()
+	fake := &fakediscovery.FakeDiscovery{
+		Fake:               &clienttesting.Fake{},
+		FakedServerVersion: &version.Info{GitVersion: "v1.20.4"},
+	}
+	updateActionConfig(t, h, testNamespace, func(cfg *action.Configuration) {
+		// discover the version instead of using the test capabilities
+		cfg.Capabilities = nil
+		cfg.RESTClientGetter = discoveryRESTClientGetter{discovery: fake}
+	})
+
+	for i := 0; i < 2; i++ {
+		got, err := h.ServerVersion(testNamespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "v1.20.4" {
+			t.Errorf("ServerVersion() = %s, want v1.20.4", got)
+		}
+	}
+	if calls := len(fake.Actions()); calls != 1 {
+		t.Errorf("discovered the server version %d times, want it cached after once", calls)
+	}
+}
+
+func TestClose(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	for i := 0; i < 2; i++ {
+		if err := h.Close(); err != nil {
+			t.Fatalf("Close() call %d failed: %v", i+1, err)
+		}
+	}
+
+	if _, err := h.ListReleases(testNamespace, ""); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("ListReleases() on a closed client returned %v, want ErrClientClosed", err)
+	}
+	if _, err := h.InstallChart("other", testChart, testValues, testNamespace, nil); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("InstallChart() on a closed client returned %v, want ErrClientClosed", err)
+	}
+	// chart operations keep no state
+	if _, err := h.RenderTemplate("web", testChart, testValues, testNamespace, nil); err != nil {
+		t.Errorf("RenderTemplate() on a closed client failed: %v", err)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	logger := newRecordingLogger()
+	h := NewHelmClientForTesting().WithLogger(logger)
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.UninstallChart("web", testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := strings.Join(logger.Messages(), "\n")
+	// from the helm action and the client itself
+	for _, want := range []string{"preparing upgrade for web", "Uninstalled release"} {
+		if !strings.Contains(messages, want) {
+			t.Errorf("logger got no %q in:\n%s", want, messages)
+		}
+	}
+}
+
+func TestRunReleaseTests(t *testing.T) {
+	h := NewHelmClientForTesting()
+	if _, err := h.InstallChart("web", testHookChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	const podPath = "/api/v1/namespaces/" + testNamespace + "/pods/web-test-greeting"
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == podPath+"/log":
+			fmt.Fprint(w, "greeting ok")
+		case r.Method == http.MethodDelete && r.URL.Path == podPath:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Success"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	updateActionConfig(t, h, testNamespace, func(cfg *action.Configuration) {
+		cfg.RESTClientGetter = testRESTClientGetter{host: server.URL}
+	})
+
+	result, err := h.RunReleaseTests("web", testNamespace, time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TestHookResult{{Name: "web-test-greeting", Phase: "Succeeded", Passed: true, Logs: "greeting ok"}}
+	if !result.Passed || len(result.Tests) != 1 || result.Tests[0] != want[0] {
+		t.Errorf("got result %+v, want passed tests %+v", result, want)
+	}
+	mu.Lock()
+	if !equalStrings(requests, []string{"GET " + podPath + "/log", "DELETE " + podPath}) {
+		t.Errorf("got API requests %v, want the logs and a delete of the test pod", requests)
+	}
+	mu.Unlock()
+
+	setKubeClient(t, h, testNamespace, &kubefake.FailingKubeClient{
+		PrintingKubeClient:   kubefake.PrintingKubeClient{Out: io.Discard},
+		WatchUntilReadyError: errors.New("pod failed"),
+	})
+	result, err = h.RunReleaseTests("web", testNamespace, time.Minute, false)
+	if err == nil {
+		t.Error("failing tests returned no error")
+	}
+	if result == nil || result.Passed || len(result.Tests) != 1 || result.Tests[0].Passed || result.Tests[0].Phase != "Failed" {
+		t.Errorf("got result %+v for failing tests", result)
+	}
+
+	if _, err := h.RunReleaseTests("missing", testNamespace, time.Minute, false); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("testing a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if stuck, err := h.IsReleaseStuck("web", testNamespace, 0); err != nil || stuck {
+		t.Errorf("IsReleaseStuck() = %v, %v for a deployed release, want false", stuck, err)
+	}
+	if err := h.ForceUnlock("web", testNamespace); err == nil {
+		t.Error("unlocking a deployed release succeeded")
+	}
+
+	// a crashed install leaves the release pending
+	setReleaseStatus(t, h, "web", testNamespace, release.StatusPendingInstall)
+	if stuck, err := h.IsReleaseStuck("web", testNamespace, time.Hour); err != nil || stuck {
+		t.Errorf("IsReleaseStuck() = %v, %v for a release pending for less than an hour, want false", stuck, err)
+	}
+	if stuck, err := h.IsReleaseStuck("web", testNamespace, 0); err != nil || !stuck {
+		t.Errorf("IsReleaseStuck() = %v, %v for a pending release, want true", stuck, err)
+	}
+	args := map[string]interface{}{"set": "replicaCount=2"}
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err == nil {
+		t.Error("upgrading a pending release succeeded")
+	}
+
+	if err := h.ForceUnlock("web", testNamespace); err != nil {
+		t.Fatal(err)
+	}
+	status, err := h.GetReleaseStatus("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != release.StatusFailed.String() {
+		t.Errorf("got status %s after unlocking, want failed", status.Status)
+	}
+	if stuck, err := h.IsReleaseStuck("web", testNamespace, 0); err != nil || stuck {
+		t.Errorf("IsReleaseStuck() = %v, %v after unlocking, want false", stuck, err)
+	}
+	result, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args)
+	if err != nil {
+		t.Fatalf("upgrading the unlocked release failed: %v", err)
+	}
+	if result.Revision != 2 {
+		t.Errorf("got revision %d after recovering, want 2", result.Revision)
+	}
+
+	if err := h.ForceUnlock("missing", testNamespace); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("unlocking a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestWaitForRelease(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// already deployed
+	if err := h.WaitForRelease(ctx, "web", testNamespace, release.StatusDeployed, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	setReleaseStatus(t, h, "web", testNamespace, release.StatusPendingUpgrade)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.WaitForRelease(ctx, "web", testNamespace, release.StatusDeployed, 10*time.Millisecond)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForRelease() returned %v before the status changed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	setReleaseStatus(t, h, "web", testNamespace, release.StatusDeployed)
+	if err := <-done; err != nil {
+		t.Errorf("WaitForRelease() = %v after the status changed", err)
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if err := h.WaitForRelease(canceled, "web", testNamespace, release.StatusFailed, time.Millisecond); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitForRelease() = %v for a canceled context, want context.Canceled", err)
+	}
+}
+
+func TestInstallCharts(t *testing.T) {
+	h := NewHelmClientForTesting()
+	var specs []InstallSpec
+	for i := 0; i < 8; i++ {
+		specs = append(specs, InstallSpec{
+			Name:       fmt.Sprintf("web-%d", i),
+			ChartPath:  testChart,
+			ValuesPath: testValues,
+			Namespace:  testNamespace,
+		})
+	}
+
+	results := h.InstallCharts(specs, 4)
+	if len(results) != len(specs) {
+		t.Fatalf("got %d results for %d specs", len(results), len(specs))
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("failed to install %s: %v", specs[i].Name, result.Err)
+			continue
+		}
+		if result.Release.Name != specs[i].Name {
+			t.Errorf("result %d is release %s, want %s", i, result.Release.Name, specs[i].Name)
+		}
+	}
+	names, err := h.ListReleases(testNamespace, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(specs) {
+		t.Errorf("got releases %v, want %d", names, len(specs))
+	}
+}
+
+// newAPIServer serves the discovery documents of the core and apps groups
+// and records the resources created through it as "namespace/kind/name"
+func newAPIServer(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+	discovery := map[string]string{
+		"/version":      `{"major":"1","minor":"18","gitVersion":"v1.18.6"}`,
+		"/api":          `{"kind":"APIVersions","versions":["v1"]}`,
+		"/apis":         `{"kind":"APIGroupList","groups":[{"name":"apps","versions":[{"groupVersion":"apps/v1","version":"v1"}],"preferredVersion":{"groupVersion":"apps/v1","version":"v1"}}]}`,
+		"/api/v1":       `{"kind":"APIResourceList","groupVersion":"v1","resources":[{"name":"services","kind":"Service","namespaced":true,"verbs":["create","get"]}]}`,
+		"/apis/apps/v1": `{"kind":"APIResourceList","groupVersion":"apps/v1","resources":[{"name":"deployments","kind":"Deployment","namespaced":true,"verbs":["create","get"]}]}`,
+	}
+	var mu sync.Mutex
+	var created []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if doc, ok := discovery[r.URL.Path]; ok && r.Method == http.MethodGet {
+			fmt.Fprint(w, doc)
+			return
+		}
+		// e.g. /apis/apps/v1/namespaces/alpha/deployments
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if r.Method != http.MethodPost || len(parts) < 4 || parts[len(parts)-3] != "namespaces" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var obj struct {
+			Metadata struct{ Name string }
+		}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		created = append(created, parts[len(parts)-2]+"/"+parts[len(parts)-1]+"/"+obj.Metadata.Name)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), created...)
+	}
+}
+
+// TestInstallChartNamespacesInParallel installs into two namespaces at the
+// same time through the kubeconfig of a fake API server, so every namespace
+// gets its own REST client getter, run it with -race
+func TestInstallChartNamespacesInParallel(t *testing.T) {
+	server, created := newAPIServer(t)
+	h := newKubeConfigClient(t, server.URL)
+	namespaces := []string{"alpha", "beta"}
+	const releases = 4
+
+	var wg sync.WaitGroup
+	for _, namespace := range namespaces {
+		for i := 0; i < releases; i++ {
+			wg.Add(1)
+			go func(namespace, name string) {
+				defer wg.Done()
+				// the fake API server serves no OpenAPI schema
+				args := map[string]interface{}{"disableOpenAPIValidation": true}
+				if _, err := h.InstallChart(name, testChart, testValues, namespace, args); err != nil {
+					t.Errorf("failed to install %s/%s: %v", namespace, name, err)
+				}
+			}(namespace, fmt.Sprintf("%s-%d", namespace, i))
+		}
+	}
+	wg.Wait()
+
+	var want []string
+	for _, namespace := range namespaces {
+		for i := 0; i < releases; i++ {
+			name := fmt.Sprintf("%s-%d", namespace, i)
+			want = append(want, namespace+"/deployments/"+name, namespace+"/services/"+name)
+		}
+
+		infos, err := h.ListReleasesDetailed(namespace, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != releases {
+			t.Errorf("namespace %s has releases %v, want %d", namespace, infos, releases)
+		}
+		for _, info := range infos {
+			if info.Namespace != namespace || !strings.HasPrefix(info.Name, namespace+"-") {
+				t.Errorf("namespace %s lists release %s/%s", namespace, info.Namespace, info.Name)
+			}
+		}
+	}
+	got := created()
+	sort.Strings(got)
+	sort.Strings(want)
+	if !equalStrings(got, want) {
+		t.Errorf("created resources %v, want %v", got, want)
+	}
+}
+
+// TestConcurrentUpgradesHistoryMax upgrades two releases at the same time
+// with different history limits, run it with -race
+func TestConcurrentUpgradesHistoryMax(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "pruned", nil)
+	installTestChart(t, h, "kept", nil)
+
+	const upgrades = 20
+	var wg sync.WaitGroup
+	upgrade := func(name string, historyMax int) {
+		defer wg.Done()
+		for i := 0; i < upgrades; i++ {
+			args := map[string]interface{}{
+				"set":        fmt.Sprintf("replicaCount=%d", i+2),
+				"historyMax": historyMax,
+			}
+			if _, err := h.InstallUpgradeChart(name, testChart, testValues, testNamespace, args); err != nil {
+				t.Errorf("failed to upgrade release %s: %v", name, err)
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go upgrade("pruned", 2)
+	go upgrade("kept", 0)
+	wg.Wait()
+
+	for name, want := range map[string]int{"pruned": 2, "kept": upgrades + 1} {
+		history, err := h.GetHistory(name, testNamespace, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != want {
+			t.Errorf("release %s has %d revisions, want %d", name, len(history), want)
+		}
+	}
+}
+
+// discoveryRESTClientGetter is testRESTClientGetter with a discovery client
+type discoveryRESTClientGetter struct {
+	testRESTClientGetter
+	discovery *fakediscovery.FakeDiscovery
+}
+
+func (g discoveryRESTClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	return cachedFakeDiscovery{g.discovery}, nil
+}
+
+type cachedFakeDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d cachedFakeDiscovery) Fresh() bool { return true }
+func (d cachedFakeDiscovery) Invalidate() {}
+
+// recordingLogger records the messages logged through it and its derived
+// loggers
+type recordingLogger struct {
+	mu       *sync.Mutex
+	messages *[]string
+}
+
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{mu: &sync.Mutex{}, messages: &[]string{}}
+}
+
+func (l recordingLogger) record(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.messages = append(*l.messages, msg)
+}
+
+func (l recordingLogger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), *l.messages...)
+}
+
+func (l recordingLogger) Info(msg string, keysAndValues ...interface{}) { l.record(msg) }
+func (l recordingLogger) Enabled() bool                                 { return true }
+func (l recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.record(msg + ": " + err.Error())
+}
+func (l recordingLogger) V(level int) logr.InfoLogger                         { return l }
+func (l recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger { return l }
+func (l recordingLogger) WithName(name string) logr.Logger                    { return l }
+
+// newParentChart writes a chart depending on testChart into a temporary
+// directory, its charts/ are empty until the dependencies are updated
+func newParentChart(t *testing.T) string {
+	t.Helper()
+	subchart, err := filepath.Abs(testChart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "parentchart")
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "Chart.yaml", `apiVersion: v2
+name: parentchart
+version: 0.1.0
+dependencies:
+  - name: mychart
+    version: 0.1.0
+    repository: file://`+subchart+"\n")
+	writeTestFile(t, dir, "templates/configmap.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-parent
+`)
+	return dir
+}
+
+// isolateHelmHome points the helm repository config and cache at an empty
+// temporary directory
+func isolateHelmHome(t *testing.T) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HELM_REPOSITORY_CONFIG", filepath.Join(home, "repositories.yaml"))
+	t.Setenv("HELM_REPOSITORY_CACHE", filepath.Join(home, "repository"))
+}
+
+// signTestChart writes the provenance file of the chart archive signed with
+// a new key and returns the path of a keyring with the public key
+func signTestChart(t *testing.T, archivePath string) string {
+	t.Helper()
+	entity, err := openpgp.NewEntity("helm client test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatory := &provenance.Signatory{Entity: entity}
+	sig, err := signatory.ClearSign(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archivePath+".prov", []byte(sig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var pubring bytes.Buffer
+	if err := entity.Serialize(&pubring); err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, t.TempDir(), "pubring.gpg", pubring.String())
+}
+
+// writeTestFile writes content to the file name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// valueAt returns the value at the dotted path in the nested vals, nil when
+// missing
+func valueAt(vals map[string]interface{}, path string) interface{} {
+	var val interface{} = vals
+	for _, key := range strings.Split(path, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = m[key]
+	}
+	return val
+}
+
+func TestGetHistory(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	for _, replicas := range []string{"2", "3"} {
+		if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=" + replicas}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := h.GetHistory("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for i, revision := range history {
+		if revision.Revision != i+1 || revision.Chart != "mychart-0.1.0" || revision.AppVersion != "1.0.0" {
+			t.Errorf("got revision %+v at %d", revision, i)
+		}
+		statuses = append(statuses, revision.Status)
+	}
+	if want := []string{"superseded", "superseded", "deployed"}; !equalStrings(statuses, want) {
+		t.Errorf("got revision statuses %v, want %v", statuses, want)
+	}
+
+	latest, err := h.GetHistory("web", testNamespace, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 || latest[0].Revision != 2 || latest[1].Revision != 3 {
+		t.Errorf("got history %+v with max 2, want revisions 2 and 3", latest)
+	}
+	if _, err := h.GetHistory("missing", testNamespace, 0); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("reading the history of a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestInstallChartWait(t *testing.T) {
+	h := NewHelmClientForTesting()
+	setKubeClient(t, h, testNamespace, &kubefake.FailingKubeClient{
+		PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+		WaitError:          wait.ErrWaitTimeout,
+	})
+
+	_, err := h.InstallChart("web", testChart, testValues, testNamespace, map[string]interface{}{"wait": true, "timeout": "30s"})
+	if !errors.Is(err, wait.ErrWaitTimeout) || !strings.Contains(err.Error(), "release web resources not ready within 30s") {
+		t.Errorf("install waiting for resources returned %v, want a wait timeout", err)
+	}
+	// the resources are not waited for without wait
+	installTestChart(t, h, "api", nil)
+
+	if _, err := h.InstallChart("worker", testChart, testValues, testNamespace, map[string]interface{}{"timeout": "soon"}); err == nil {
+		t.Error("installing with an invalid timeout succeeded")
+	}
+}
+
+func TestInstallChartFromRepo(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	server := newTestRepo(t, "user", "secret", "0.1.0", "0.2.0")
+	credentials := map[string]interface{}{"username": "user", "password": "secret"}
+
+	if _, err := h.InstallChartFromRepo("web", server.URL, "mychart", "0.1.0", testValues, testNamespace, credentials); err != nil {
+		t.Fatal(err)
+	}
+	if version := lastRelease(t, h, "web", testNamespace).Chart.Metadata.Version; version != "0.1.0" {
+		t.Errorf("installed chart version %s, want 0.1.0", version)
+	}
+
+	if _, err := h.InstallChartFromRepo("api", server.URL, "mychart", "0.1.0", testValues, testNamespace, nil); err == nil {
+		t.Error("installing without credentials succeeded")
+	}
+	if _, err := h.InstallChartFromRepo("api", server.URL, "missing", "", testValues, testNamespace, credentials); err == nil {
+		t.Error("installing a missing chart succeeded")
+	}
+}
+
+func TestInvalidateConfigCache(t *testing.T) {
+	h := NewHelmClientForTesting()
+	calls := 0
+	h.initConfig = func(namespace string) (*action.Configuration, error) {
+		calls++
+		return h.newTestingActionConfig(namespace), nil
+	}
+
+	installTestChart(t, h, "web", nil)
+	if _, err := h.ListReleases(testNamespace, ""); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d configuration initializations, want the cached one", calls)
+	}
+	h.InvalidateConfigCache(testNamespace)
+	names, err := h.ListReleases(testNamespace, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d configuration initializations after invalidating the cache, want 2", calls)
+	}
+	if !equalStrings(names, []string{"web"}) {
+		t.Errorf("got releases %v after invalidating the cache, want web", names)
+	}
+}
+
+func TestGetReleaseStatus(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	status, err := h.GetReleaseStatus("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "web" || status.Namespace != testNamespace || status.Status != "deployed" || status.Revision != 1 {
+		t.Errorf("got status %+v, want revision 1 of web deployed in %s", status, testNamespace)
+	}
+	if status.LastDeployed.IsZero() || !strings.Contains(status.Manifest, "kind: Deployment") || status.Resources != nil {
+		t.Errorf("got status %+v, want the deploy time and manifest without resources", status)
+	}
+	if _, err := h.GetReleaseStatus("missing", testNamespace, false); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("reading the status of a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// diffContext is the number of unchanged lines shown around changes
+const diffContext = 3
+
+// DiffRelease returns a unified diff of the manifests of two revisions of a
+// release. A toRevision of 0 is the latest revision and a fromRevision of 0
+// the one before toRevision, it returns ErrInvalidRevision when there is no
+// such revision.
+func (h *HelmClient) DiffRelease(name, namespace string, fromRevision, toRevision int) (string, error) {
+	if toRevision == 0 {
+		status, err := h.GetReleaseStatus(name, namespace, false)
+		if err != nil {
+			return "", err
+		}
+		toRevision = status.Revision
+	}
+	if fromRevision == 0 {
+		fromRevision = toRevision - 1
+		if fromRevision < 1 {
+			return "", errors.Wrapf(ErrInvalidRevision, "release %s has no revision before revision %d", name, toRevision)
+		}
+	}
+	fromManifest, err := h.GetReleaseManifest(name, namespace, fromRevision)
+	if err != nil {
+		return "", err
+	}
+	toManifest, err := h.GetReleaseManifest(name, namespace, toRevision)
+	if err != nil {
+		return "", err
+	}
+	return diffManifests(
+		fmt.Sprintf("%s revision %d", name, fromRevision), fromManifest,
+		fmt.Sprintf("%s revision %d", name, toRevision), toManifest), nil
+}
+
+// DiffUpgrade returns a unified diff of the manifest of the latest release
+// revision against the one a dry-run upgrade with the chart would apply
+func (h *HelmClient) DiffUpgrade(name, chartPath, valuesPath, namespace string, args map[string]interface{}) (string, error) {
+	opts, err := installOptionsFromArgs(args)
+	if err != nil {
+		return "", err
+	}
+	return h.diffUpgrade(name, chartPath, valuesPath, namespace, opts)
+}
+
+func (h *HelmClient) diffUpgrade(name, chartPath, valuesPath, namespace string, opts InstallOptions) (string, error) {
+	liveManifest, err := h.GetReleaseManifest(name, namespace, 0)
+	if err != nil {
+		return "", err
+	}
+
+	opts.DryRun, opts.ServerDryRun = true, false
+	rel, _, err := h.installUpgradeChart(context.Background(), name, chartPath, valuesPath, namespace, opts, false)
+	if err != nil {
+		return "", err
+	}
+	return diffManifests(name+" live", liveManifest, name+" upgrade", rel.Manifest), nil
+}
+
+// HasDrift tells whether an upgrade of the release with the chart would
+// change its manifest, returning the diff as in DiffUpgrade as summary. Only
+// the manifest stored with the latest revision is compared, resources
+// changed in the cluster behind helm's back are not detected.
+func (h *HelmClient) HasDrift(name, chartPath, valuesPath, namespace string, opts InstallOptions) (bool, string, error) {
+	diff, err := h.diffUpgrade(name, chartPath, valuesPath, namespace, opts)
+	if err != nil {
+		return false, "", err
+	}
+	return diff != "", diff, nil
+}
+
+// diffManifests diffs the two manifests template by template
+func diffManifests(fromName, from, toName, to string) string {
+	fromDocs := splitManifestSources(from)
+	toDocs := splitManifestSources(to)
+
+	var sources []string
+	for source := range fromDocs {
+		sources = append(sources, source)
+	}
+	for source := range toDocs {
+		if _, ok := fromDocs[source]; !ok {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+
+	var diff strings.Builder
+	for _, source := range sources {
+		fromDoc, toDoc := fromDocs[source], toDocs[source]
+		if fromDoc == toDoc {
+			continue
+		}
+		fmt.Fprintf(&diff, "--- %s/%s\n+++ %s/%s\n", fromName, source, toName, source)
+		diff.WriteString(unifiedDiff(splitLines(fromDoc), splitLines(toDoc)))
+	}
+	return diff.String()
+}
+
+// splitManifestSources groups the YAML documents of a manifest by the
+// template named in their "# Source:" comment
+func splitManifestSources(manifest string) map[string]string {
+	docs := map[string]string{}
+	for _, doc := range strings.Split("\n"+manifest, "\n---\n") {
+		doc = strings.TrimSpace(doc)
+		if doc == "" {
+			continue
+		}
+		source := "manifest"
+		for _, line := range strings.Split(doc, "\n") {
+			if strings.HasPrefix(line, "# Source: ") {
+				source = strings.TrimPrefix(line, "# Source: ")
+				break
+			}
+		}
+		if existing, ok := docs[source]; ok {
+			doc = existing + "\n---\n" + doc
+		}
+		docs[source] = doc
+	}
+	return docs
+}
+
+func splitLines(doc string) []string {
+	if doc == "" {
+		return nil
+	}
+	return strings.Split(doc, "\n")
+}
+
+type diffLine struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns the hunks turning a into b
+func unifiedDiff(a, b []string) string {
+	lines := diffLines(a, b)
+
+	var diff strings.Builder
+	for start := 0; start < len(lines); {
+		// find the next change
+		first := start
+		for first < len(lines) && lines[first].kind == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		// extend the hunk while changes are close enough to share context
+		last := first
+		for i := first + 1; i < len(lines) && i-last <= 2*diffContext; i++ {
+			if lines[i].kind != ' ' {
+				last = i
+			}
+		}
+		hunkStart := first - diffContext
+		if hunkStart < start {
+			hunkStart = start
+		}
+		hunkEnd := last + diffContext + 1
+		if hunkEnd > len(lines) {
+			hunkEnd = len(lines)
+		}
+
+		aStart, bStart := 1, 1
+		for _, line := range lines[:hunkStart] {
+			if line.kind != '+' {
+				aStart++
+			}
+			if line.kind != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, line := range lines[hunkStart:hunkEnd] {
+			if line.kind != '+' {
+				aLen++
+			}
+			if line.kind != '-' {
+				bLen++
+			}
+		}
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&diff, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, line := range lines[hunkStart:hunkEnd] {
+			fmt.Fprintf(&diff, "%c%s\n", line.kind, line.text)
+		}
+		start = hunkEnd
+	}
+	return diff.String()
+}
+
+// diffLines returns a shortest edit script of a into b. It uses the linear
+// space variant of Myers' algorithm, the work grows with the size of the
+// inputs times the number of changes instead of the product of their sizes.
+func diffLines(a, b []string) []diffLine {
+	d := differ{a: a, b: b}
+	d.compare(0, len(a), 0, len(b))
+	return d.lines
+}
+
+type differ struct {
+	a, b  []string
+	lines []diffLine
+}
+
+// compare appends the edit script of a[a0:a1] into b[b0:b1]
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.lines = append(d.lines, diffLine{' ', d.a[a0]})
+		a0++
+		b0++
+	}
+	suffix := a1
+	for a1 > a0 && b1 > b0 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+	}
+
+	if x, y, ok := d.middleSnake(a0, a1, b0, b1); ok {
+		d.compare(a0, x, b0, y)
+		d.compare(x, a1, y, b1)
+	} else {
+		for _, line := range d.a[a0:a1] {
+			d.lines = append(d.lines, diffLine{'-', line})
+		}
+		for _, line := range d.b[b0:b1] {
+			d.lines = append(d.lines, diffLine{'+', line})
+		}
+	}
+	for _, line := range d.a[a1:suffix] {
+		d.lines = append(d.lines, diffLine{' ', line})
+	}
+}
+
+// middleSnake searches a shortest edit script of a[a0:a1] into b[b0:b1]
+// from both ends at once and returns the point where the searches meet,
+// which splits the script in two halves. It returns false when both ranges
+// are empty or have no line in common.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (int, int, bool) {
+	n, m := a1-a0, b1-b0
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	// vf[offset+k] is the furthest x reached on diagonal k = x-y from the
+	// start, vb the same from the end
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+	delta := n - m
+	// with an odd delta the forward search meets the backward one first
+	odd := delta%2 != 0
+	// the diagonals leaving the ranges are no longer searched
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for D := 0; D < maxD; D++ {
+		for k := -D + fStart; k <= D-fEnd; k += 2 {
+			var x int
+			if k == -D || (k != D && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				if i := offset + delta - k; i >= 0 && i < len(vb) && vb[i] != -1 && x >= n-vb[i] {
+					return a0 + x, b0 + y, true
+				}
+			}
+		}
+		for k := -D + bStart; k <= D-bEnd; k += 2 {
+			var x int
+			if k == -D || (k != D && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[a1-1-x] == d.b[b1-1-y] {
+				x++
+				y++
+			}
+			vb[offset+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				if i := offset + delta - k; i >= 0 && i < len(vf) && vf[i] != -1 && vf[i] >= n-x {
+					fx := vf[i]
+					return a0 + fx, b0 + fx - (delta - k), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDiffRelease(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := h.DiffRelease("web", testNamespace, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"-  replicas: 1", "+  replicas: 3"} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff has no %q:\n%s", want, diff)
+		}
+	}
+	if strings.Contains(diff, "kind: Service") {
+		t.Errorf("diff has the unchanged Service:\n%s", diff)
+	}
+
+	same, err := h.DiffRelease("web", testNamespace, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != "" {
+		t.Errorf("diff of a revision with itself is not empty:\n%s", same)
+	}
+}
+
+func TestDiffReleaseFirstRevision(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	if diff, err := h.DiffRelease("web", testNamespace, 0, 0); !errors.Is(err, ErrInvalidRevision) {
+		t.Errorf("DiffRelease() = %q, %v without an earlier revision, want ErrInvalidRevision", diff, err)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		changes int
+	}{
+		{"", "", 0},
+		{"a b c", "a b c", 0},
+		{"", "a b", 2},
+		{"a b", "", 2},
+		{"a b c a b b a", "c b a b a c", 5},
+		{"a b c d", "x b c y", 4},
+	}
+	for _, tt := range tests {
+		a, b := strings.Fields(tt.a), strings.Fields(tt.b)
+		checkDiffLines(t, a, b, tt.changes)
+	}
+
+	// a table of the common subsequences of these would not fit in memory
+	var a, b []string
+	for i := 0; i < 100000; i++ {
+		a = append(a, fmt.Sprintf("line %d", i))
+		if i%1000 != 0 {
+			b = append(b, fmt.Sprintf("line %d", i))
+		}
+	}
+	checkDiffLines(t, a, b, 100)
+}
+
+// checkDiffLines checks that diffLines turns a into b with changes edits
+func checkDiffLines(t *testing.T, a, b []string, changes int) {
+	t.Helper()
+	var gotA, gotB []string
+	edits := 0
+	for _, line := range diffLines(a, b) {
+		if line.kind != '+' {
+			gotA = append(gotA, line.text)
+		}
+		if line.kind != '-' {
+			gotB = append(gotB, line.text)
+		}
+		if line.kind != ' ' {
+			edits++
+		}
+	}
+	if !equalStrings(gotA, a) || !equalStrings(gotB, b) {
+		t.Errorf("diffLines(%q, %q) does not turn one into the other", a, b)
+	}
+	if edits != changes {
+		t.Errorf("diffLines(%q, %q) has %d edits, want %d", a, b, edits, changes)
+	}
+}
+
+func TestDiffUpgrade(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	diff, err := h.DiffUpgrade("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "+  replicas: 2") {
+		t.Errorf("diff has no replica change:\n%s", diff)
+	}
+	if revision := lastRelease(t, h, "web", testNamespace).Version; revision != 1 {
+		t.Errorf("got revision %d after the diff, want 1", revision)
+	}
+}
+
+func TestHasDrift(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", map[string]interface{}{"set": "replicaCount=2"})
+
+	drift, summary, err := h.HasDrift("web", testChart, "", testNamespace, InstallOptions{Set: "replicaCount=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift || summary != "" {
+		t.Errorf("HasDrift() = %v, %q right after the install, want no drift", drift, summary)
+	}
+
+	drift, summary, err = h.HasDrift("web", testChart, "", testNamespace, InstallOptions{Set: "replicaCount=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !drift || !strings.Contains(summary, "-  replicas: 2") || !strings.Contains(summary, "+  replicas: 3") {
+		t.Errorf("HasDrift() = %v, %q after a values change, want the replicas diff", drift, summary)
+	}
+	// the check does not upgrade
+	if revision := lastRelease(t, h, "web", testNamespace).Version; revision != 1 {
+		t.Errorf("got revision %d after checking for drift, want 1", revision)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+)
+
+// HelmEventStage is the phase an install or upgrade entered
+type HelmEventStage string
+
+const (
+	EventLoadingChart HelmEventStage = "LoadingChart"
+	EventRendering    HelmEventStage = "Rendering"
+	EventApplying     HelmEventStage = "Applying"
+	EventWaiting      HelmEventStage = "Waiting"
+	EventSucceeded    HelmEventStage = "Succeeded"
+	EventFailed       HelmEventStage = "Failed"
+)
+
+// HelmEvent is passed to the hook of WithEventHook when an install or
+// upgrade enters a stage
+type HelmEvent struct {
+	Stage     HelmEventStage
+	Release   string
+	Namespace string
+	// Err is set for EventFailed
+	Err error
+}
+
+// WithEventHook makes the client call hook whenever an install or upgrade
+// enters the next stage, e.g. to report progress. Dry runs report no
+// events. hook is called synchronously, so it should return quickly. Call it
+// before using the client.
+func (h *HelmClient) WithEventHook(hook func(event HelmEvent)) *HelmClient {
+	h.helmMutex.Lock()
+	defer h.helmMutex.Unlock()
+
+	h.eventHook = hook
+	return h
+}
+
+// newEventEmitter returns a func passing the stages of the release to the
+// event hook, repeated stages are reported once
+func (h *HelmClient) newEventEmitter(name, namespace string) func(stage HelmEventStage, err error) {
+	var last HelmEventStage
+	return func(stage HelmEventStage, err error) {
+		if h.eventHook == nil || stage == last {
+			return
+		}
+		last = stage
+		h.eventHook(HelmEvent{Stage: stage, Release: name, Namespace: namespace, Err: err})
+	}
+}
+
+// noEvents is the emitter of dry runs, which report no events
+func noEvents(stage HelmEventStage, err error) {}
+
+// withEventKubeClient makes the kube client of actionConfig report the
+// applying and waiting stages, helm runs them inside a single action
+func (h *HelmClient) withEventKubeClient(actionConfig *action.Configuration, emit func(stage HelmEventStage, err error)) {
+	if h.eventHook == nil {
+		return
+	}
+	actionConfig.KubeClient = &eventKubeClient{Interface: actionConfig.KubeClient, emit: emit}
+}
+
+type eventKubeClient struct {
+	kube.Interface
+	emit func(stage HelmEventStage, err error)
+}
+
+func (c *eventKubeClient) Create(resources kube.ResourceList) (*kube.Result, error) {
+	c.emit(EventApplying, nil)
+	return c.Interface.Create(resources)
+}
+
+func (c *eventKubeClient) Update(original, target kube.ResourceList, force bool) (*kube.Result, error) {
+	c.emit(EventApplying, nil)
+	return c.Interface.Update(original, target, force)
+}
+
+func (c *eventKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
+	c.emit(EventWaiting, nil)
+	return c.Interface.Wait(resources, timeout)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+)
+
+func TestWithEventHook(t *testing.T) {
+	var mu sync.Mutex
+	var events []HelmEvent
+	h := NewHelmClientForTesting().WithEventHook(func(event HelmEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	stages := func() []HelmEventStage {
+		mu.Lock()
+		defer mu.Unlock()
+		var stages []HelmEventStage
+		for _, event := range events {
+			if event.Release != "web" || event.Namespace != testNamespace {
+				t.Errorf("got event %+v for another release", event)
+			}
+			stages = append(stages, event.Stage)
+		}
+		events = nil
+		return stages
+	}
+	succeeded := []HelmEventStage{EventLoadingChart, EventRendering, EventApplying, EventWaiting, EventSucceeded}
+
+	installTestChart(t, h, "web", map[string]interface{}{"wait": true})
+	// the fake kube client builds no resources, so helm creates none and
+	// the install skips applying
+	installed := []HelmEventStage{EventLoadingChart, EventRendering, EventWaiting, EventSucceeded}
+	if got := stages(); !reflect.DeepEqual(got, installed) {
+		t.Errorf("install reported stages %v, want %v", got, installed)
+	}
+
+	args := map[string]interface{}{"set": "replicaCount=2", "wait": true}
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+		t.Fatal(err)
+	}
+	if got := stages(); !reflect.DeepEqual(got, succeeded) {
+		t.Errorf("upgrade reported stages %v, want %v", got, succeeded)
+	}
+
+	args = map[string]interface{}{"set": "replicaCount=3", "dryRun": true}
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, args); err != nil {
+		t.Fatal(err)
+	}
+	if got := stages(); len(got) != 0 {
+		t.Errorf("dry run reported stages %v", got)
+	}
+
+	setKubeClient(t, h, testNamespace, &partialFailureKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}})
+	if _, err := h.InstallUpgradeChart("web", testChart, testValues, testNamespace, map[string]interface{}{"set": "replicaCount=4"}); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	mu.Lock()
+	last := events[len(events)-1]
+	mu.Unlock()
+	failed := []HelmEventStage{EventLoadingChart, EventRendering, EventApplying, EventFailed}
+	if got := stages(); !reflect.DeepEqual(got, failed) || last.Err == nil {
+		t.Errorf("failed upgrade reported stages %v with error %v, want %v with an error", got, last.Err, failed)
+	}
+}
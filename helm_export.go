@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/yaml"
+)
+
+// exportedRelease is the content of the metadata.json written by
+// ExportRelease
+type exportedRelease struct {
+	Name         string          `json:"name"`
+	Namespace    string          `json:"namespace"`
+	Revision     int             `json:"revision"`
+	Status       string          `json:"status,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	LastDeployed time.Time       `json:"lastDeployed"`
+	Chart        *chart.Metadata `json:"chart,omitempty"`
+}
+
+// ExportRelease writes the state of the latest release revision into destDir,
+// creating it when missing: the user supplied values to values.yaml, the
+// rendered manifest to manifest.yaml and the release and chart metadata to
+// metadata.json. Existing files are overwritten. values.yaml can be passed
+// as values file to reinstall the chart version named in metadata.json.
+func (h *HelmClient) ExportRelease(name, namespace, destDir string) error {
+	rel, err := h.GetRelease(name, namespace, 0)
+	if err != nil {
+		return err
+	}
+
+	config := rel.Config
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	values, err := yaml.Marshal(config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal values of release %s", name)
+	}
+
+	meta := exportedRelease{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+	}
+	if rel.Info != nil {
+		meta.Status = rel.Info.Status.String()
+		meta.Description = rel.Info.Description
+		meta.LastDeployed = rel.Info.LastDeployed.Time
+	}
+	if rel.Chart != nil {
+		meta.Chart = rel.Chart.Metadata
+	}
+	metadata, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal metadata of release %s", name)
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"values.yaml", values},
+		{"manifest.yaml", []byte(rel.Manifest)},
+		{"metadata.json", append(metadata, '\n')},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(destDir, f.name), f.data, 0644); err != nil {
+			return errors.Wrapf(err, "failed to export release %s", name)
+		}
+	}
+	h.logger().Info("Exported release", "name", name, "namespace", namespace, "revision", rel.Version, "dir", destDir)
+	return nil
+}
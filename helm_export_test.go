@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestExportRelease(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", map[string]interface{}{"set": "replicaCount=3"})
+	dir := filepath.Join(t.TempDir(), "export")
+	if err := h.ExportRelease("web", testNamespace, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || fmt.Sprint(values["replicaCount"]) != "3" {
+		t.Errorf("exported values %v, want the user supplied replicaCount=3", values)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := h.GetReleaseManifest("web", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != manifest {
+		t.Errorf("exported manifest %q, want the release manifest %q", data, manifest)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta exportedRelease
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != "web" || meta.Namespace != testNamespace || meta.Revision != 1 || meta.Status != "deployed" {
+		t.Errorf("exported metadata %+v, want revision 1 of the deployed release", meta)
+	}
+	if meta.Chart == nil || meta.Chart.Name != "mychart" || meta.Chart.Version != "0.1.0" {
+		t.Errorf("exported chart metadata %+v, want mychart 0.1.0", meta.Chart)
+	}
+
+	// the exported values reinstall the release
+	if _, err := h.InstallChart("restored", testChart, filepath.Join(dir, "values.yaml"), testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := h.GetReleaseValues("restored", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(restored["replicaCount"]) != "3" {
+		t.Errorf("got values %v from the exported values file", restored)
+	}
+
+	if err := h.ExportRelease("missing", testNamespace, dir); err == nil {
+		t.Error("exporting a missing release succeeded")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// InstallOptions are the settings of InstallChartWithOptions and
+// InstallUpgradeChartWithOptions, the zero value installs with the chart
+// defaults and waits for nothing. The deprecated InstallChart and
+// InstallUpgradeChart take the same settings as args map, see
+// installOptionsFromArgs.
+type InstallOptions struct {
+	// Set, SetString, SetFile and SetJSON are the values of the helm
+	// --set, --set-string, --set-file and --set-json flags. Keys are dotted
+	// paths into the nested values, like with helm a key prefixed with a
+	// subchart name or alias, e.g. "redis.auth.enabled", sets a value of that
+	// subchart. SetString keeps values like "true" or "01234" as strings and
+	// SetFile takes key=path pairs whose file contents become the values.
+	// SetJSON is a JSON object deep merged into the values before the others,
+	// arrays are replaced as a whole.
+	Set       string
+	SetString string
+	SetFile   string
+	SetJSON   string
+	// SetMap holds --set keys to values, commas in values need no escaping
+	SetMap map[string]string
+
+	// DryRun renders the chart client side without contacting the cluster
+	// or recording a release. The returned manifest then holds every
+	// rendered template of the chart and its subcharts; hooks, tests and the
+	// crds/ directory are not part of it.
+	DryRun bool
+	// ServerDryRun renders with the capabilities of the cluster instead and
+	// submits the resources to it as a server-side dry run, see serverDryRun
+	ServerDryRun bool
+	// KubeVersion, e.g. "v1.18.0", is the .Capabilities.KubeVersion client
+	// side dry runs render with, v1.16.0 when empty like `helm template`.
+	// APIVersions adds API versions like "policy/v1" or
+	// "monitoring.coreos.com/v1/ServiceMonitor" to .Capabilities.APIVersions.
+	KubeVersion string
+	APIVersions []string
+	// IncludeCRDs adds the crds/ directory to the manifest of dry runs
+	// unless SkipCRDs is set
+	IncludeCRDs bool
+
+	// GenerateName lets helm generate the release name from the chart name,
+	// the name must be empty then. The result holds the generated name.
+	GenerateName bool
+	// NameTemplate renders the release name from a Go template with the
+	// sprig functions, e.g. "tenant-{{ randAlpha 6 | lower }}". The name must
+	// be empty then and the result holds the rendered name.
+	NameTemplate string
+	// Description replaces the "Install complete" description of the
+	// revision shown by GetHistory, e.g. with a deploy commit message
+	Description string
+
+	// NoHooks skips every hook of the chart: the install and upgrade hooks
+	// are not run and their resources not created. Test hooks are still
+	// stored with the release for RunReleaseTests.
+	NoHooks bool
+	// DependencyUpdate downloads missing chart dependencies first
+	DependencyUpdate bool
+	// CreateNamespace creates the release namespace when it does not exist
+	CreateNamespace bool
+	// SkipCRDs does not install the crds/ directory of the chart, for
+	// clusters managing CRDs out-of-band. Helm never upgrades or deletes
+	// CRDs, so upgrades leave installed CRDs as they are either way.
+	SkipCRDs bool
+	// DisableOpenAPIValidation skips validating the rendered manifests
+	// against the OpenAPI schema of the cluster, for custom resources with
+	// incomplete schemas. Typos and invalid fields are then only caught, or
+	// silently dropped, by the API server, so prefer fixing the CRD schema.
+	DisableOpenAPIValidation bool
+	// Verify checks the provenance file next to the chart archive against
+	// Keyring, ~/.gnupg/pubring.gpg when empty, and fails the install when
+	// the signature does not match, see verifyChart
+	Verify  bool
+	Keyring string
+	// PostRenderer mutates the rendered manifests before they are applied
+	PostRenderer postrender.PostRenderer
+
+	// DownloadTimeout bounds the download of a chart path that is an http(s)
+	// URL, 2m when 0, see fetchChart. ChartSHA256 fails the install unless
+	// the downloaded archive has that hex sha256 digest.
+	DownloadTimeout time.Duration
+	ChartSHA256     string
+
+	// Wait blocks until the release resources are ready, for at most
+	// Timeout. WaitForJobs requires it and also waits for the Jobs of the
+	// release to complete within the same timeout, see waitForJobs.
+	Wait        bool
+	WaitForJobs bool
+	// Timeout bounds waits and hooks, 5m when 0
+	Timeout time.Duration
+
+	// CleanupOnFail deletes the resources a failed install or upgrade
+	// created. Resources an install adopted, hook resources and the
+	// namespace of CreateNamespace are kept, as is the failed release, which
+	// InstallUpgradeChartWithOptions upgrades and UninstallChart removes.
+	CleanupOnFail bool
+	// Atomic rolls a failed upgrade back to the last successful revision
+	// and implies Wait
+	Atomic bool
+	// Force deletes and recreates the resources an upgrade cannot patch in
+	// place, e.g. on immutable field changes. The recreated resources are
+	// unavailable in between and lose anything not in the manifest, like the
+	// pods of a recreated Deployment, so expect downtime.
+	Force bool
+	// ReuseValues merges the given values over the ones of the current
+	// release on upgrades, ResetValues drops them for the chart defaults.
+	// The two are mutually exclusive.
+	ReuseValues bool
+	ResetValues bool
+	// HistoryMax is the number of revisions upgrades keep, older ones are
+	// pruned. 10 when 0 and every revision when negative.
+	HistoryMax int
+}
+
+// RollbackOptions are the settings of RollbackReleaseWithOptions, the zero
+// value rolls back like RollbackRelease without waiting, as helm does
+type RollbackOptions struct {
+	// Wait blocks until the resources of the rolled back revision are ready
+	Wait bool
+	// Timeout bounds the wait and the hooks, 5m when 0
+	Timeout time.Duration
+	// CleanupOnFail deletes the resources a failed rollback created
+	CleanupOnFail bool
+}
+
+// ListSortBy is the order ListReleasesWithOptions returns releases in
+type ListSortBy string
+
+const (
+	// SortByName sorts releases by name
+	SortByName ListSortBy = "name"
+	// SortByDate sorts releases by the time their latest revision was deployed
+	SortByDate ListSortBy = "date"
+)
+
+// ListOptions sort and page the releases of ListReleasesWithOptions, the zero
+// value lists every release sorted by name
+type ListOptions struct {
+	// Limit is the maximum number of releases returned, 0 for no limit
+	Limit int
+	// Offset is the number of releases skipped before the first returned one
+	Offset int
+	// SortBy is SortByName when empty
+	SortBy ListSortBy
+	// Descending reverses the order, e.g. latest deployed first
+	Descending bool
+}
+
+// InstallChartWithOptions installs the chart and returns the release name,
+// revision, rendered manifest and notes. An empty valuesPath installs with
+// the chart defaults. chartPath may be the http(s) URL of a chart archive,
+// which is downloaded to a temporary file first, see fetchChart.
+func (h *HelmClient) InstallChartWithOptions(name, chartPath, valuesPath, namespace string, opts InstallOptions) (*ReleaseResult, error) {
+	return h.installChartContext(context.Background(), name, chartPath, valuesPath, namespace, opts)
+}
+
+// InstallUpgradeChartWithOptions upgrades the release, installing it when
+// it has no deployed revision yet, and returns the release like
+// InstallChartWithOptions. A dry run still reads the current release.
+//
+// When the deployed revision already runs the same chart with the same
+// values and the upgrade renders the same manifest no new revision is
+// created, the result holds the deployed revision with Unchanged set.
+// Resources changed in the cluster behind helm's back are not reverted then.
+// Upgrades with Force or a Description are never skipped.
+func (h *HelmClient) InstallUpgradeChartWithOptions(name, chartPath, valuesPath, namespace string, opts InstallOptions) (*ReleaseResult, error) {
+	return h.installUpgradeChartContext(context.Background(), name, chartPath, valuesPath, namespace, opts)
+}
+
+// UpgradeIfHealthy is InstallUpgradeChartWithOptions refusing to upgrade,
+// or install, unless the latest release revision is deployed, so that no
+// changes are stacked on a failed or pending release. It returns
+// ErrReleaseNotHealthy otherwise and ErrReleaseNotFound without a release.
+func (h *HelmClient) UpgradeIfHealthy(name, chartPath, valuesPath, namespace string, opts InstallOptions) error {
+	exists, status, err := h.ReleaseExistsWithStatus(name, namespace)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Wrapf(ErrReleaseNotFound, "release %s in namespace %s", name, namespace)
+	}
+	if status != release.StatusDeployed {
+		return errors.Wrapf(ErrReleaseNotHealthy, "release %s in namespace %s is %s", name, namespace, status)
+	}
+	_, err = h.InstallUpgradeChartWithOptions(name, chartPath, valuesPath, namespace, opts)
+	return err
+}
+
+// InstallLoadedChart installs the chart already loaded or built in memory,
+// e.g. a generated one, with vals as values file content like
+// InstallChartWithOptions. vals is not modified. Options that need the chart
+// on disk, Verify and DependencyUpdate, are not supported and the
+// dependencies of the chart must be part of it.
+func (h *HelmClient) InstallLoadedChart(name string, ch *chart.Chart, vals map[string]interface{}, namespace string, opts InstallOptions) (*ReleaseResult, error) {
+	if ch == nil || ch.Metadata == nil {
+		return nil, errors.New("chart and its metadata are required")
+	}
+	if opts.Verify || opts.DependencyUpdate {
+		return nil, errors.Errorf("verify and dependencyUpdate need a chart path, cannot be used for chart %s", ch.Name())
+	}
+	actionConfig, err := h.installActionConfig(context.Background(), namespace, opts)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := h.installWithConfig(context.Background(), actionConfig, name, ch.Name(), namespace, opts, func() (*chart.Chart, map[string]interface{}, error) {
+		if ch.Metadata.Dependencies != nil {
+			if err := action.CheckDependencies(ch, ch.Metadata.Dependencies); err != nil {
+				return nil, nil, err
+			}
+		}
+		return ch, copyValues(vals), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.waitedReleaseResult(rel, namespace, opts), nil
+}
+
+// copyValues deep copies the nested maps of vals, which the set args are
+// parsed into
+func copyValues(vals map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(vals))
+	for k, v := range vals {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = copyValues(m)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// installOptionsFromArgs translates the args of InstallChart and
+// InstallUpgradeChart into options. Each key is the name of the option in
+// lower camel case, e.g. args["dryRun"] for DryRun, with the type of the
+// option, except that:
+//
+// args["dryRun"] may also be one of "none", "client", the same as true,
+// and "server", which sets ServerDryRun.
+//
+// args["timeout"] and args["downloadTimeout"] are duration strings like
+// "90s".
+//
+// args["postRenderer"] may also be the path of a post-renderer executable.
+//
+// args["historyMax"] is 10 when unset and 0 keeps every revision.
+//
+// Unknown keys are ignored.
+func installOptionsFromArgs(args map[string]interface{}) (InstallOptions, error) {
+	var opts InstallOptions
+	var err error
+	if opts.Set, err = setArg(args, "set"); err != nil {
+		return InstallOptions{}, err
+	}
+	if opts.SetString, err = setArg(args, "setString"); err != nil {
+		return InstallOptions{}, err
+	}
+	if opts.SetFile, err = setArg(args, "setFile"); err != nil {
+		return InstallOptions{}, err
+	}
+	if opts.SetJSON, err = setArg(args, "setJSON"); err != nil {
+		return InstallOptions{}, err
+	}
+	if val, ok := args["setMap"]; ok && val != nil {
+		if opts.SetMap, ok = val.(map[string]string); !ok {
+			return InstallOptions{}, errors.Errorf("setMap must be a map[string]string, got %T", val)
+		}
+	}
+
+	dryRun, err := dryRunArg(args)
+	if err != nil {
+		return InstallOptions{}, err
+	}
+	opts.DryRun = dryRun == dryRunClient
+	opts.ServerDryRun = dryRun == dryRunServer
+	opts.KubeVersion = stringArg(args, "kubeVersion")
+	if val, ok := args["apiVersions"]; ok && val != nil {
+		if opts.APIVersions, ok = val.([]string); !ok {
+			return InstallOptions{}, errors.Errorf("apiVersions must be a []string, got %T", val)
+		}
+	}
+	opts.IncludeCRDs = boolArg(args, "includeCRDs")
+
+	opts.GenerateName = boolArg(args, "generateName")
+	opts.NameTemplate = stringArg(args, "nameTemplate")
+	opts.Description = stringArg(args, "description")
+
+	opts.NoHooks = boolArg(args, "noHooks")
+	opts.DependencyUpdate = boolArg(args, "dependencyUpdate")
+	opts.CreateNamespace = boolArg(args, "createNamespace")
+	opts.SkipCRDs = boolArg(args, "skipCRDs")
+	opts.DisableOpenAPIValidation = boolArg(args, "disableOpenAPIValidation")
+	opts.Verify = boolArg(args, "verify")
+	opts.Keyring = stringArg(args, "keyring")
+	if opts.PostRenderer, err = postRendererArg(args); err != nil {
+		return InstallOptions{}, err
+	}
+
+	if opts.DownloadTimeout, err = durationArg(args, "downloadTimeout", 0); err != nil {
+		return InstallOptions{}, err
+	}
+	opts.ChartSHA256 = stringArg(args, "chartSHA256")
+
+	opts.Wait = boolArg(args, "wait")
+	opts.WaitForJobs = boolArg(args, "waitForJobs")
+	if opts.Timeout, err = durationArg(args, "timeout", 0); err != nil {
+		return InstallOptions{}, err
+	}
+
+	opts.CleanupOnFail = boolArg(args, "cleanupOnFail")
+	opts.Atomic = boolArg(args, "atomic")
+	opts.Force = boolArg(args, "force")
+	opts.ReuseValues = boolArg(args, "reuseValues")
+	opts.ResetValues = boolArg(args, "resetValues")
+	historyMax, err := intArg(args, "historyMax", 0)
+	if err != nil {
+		return InstallOptions{}, err
+	}
+	opts.HistoryMax = historyMax
+	if v, ok := args["historyMax"]; ok && v != nil && historyMax <= 0 {
+		opts.HistoryMax = -1
+	}
+	return opts, nil
+}
+
+// dryRun returns the dry run strategy of the options, empty for none
+func (o InstallOptions) dryRun() string {
+	switch {
+	case o.ServerDryRun:
+		return dryRunServer
+	case o.DryRun:
+		return dryRunClient
+	}
+	return ""
+}
+
+// timeout returns Timeout, defaultTimeout when unset
+func (o InstallOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return o.Timeout
+}
+
+// historyMax returns the MaxHistory of the helm upgrade, 0 for no limit
+func (o InstallOptions) historyMax() int {
+	switch {
+	case o.HistoryMax < 0:
+		return 0
+	case o.HistoryMax == 0:
+		return defaultHistoryMax
+	}
+	return o.HistoryMax
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+func TestInstallOptionsFromArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		want InstallOptions
+	}{
+		{"nil", nil, InstallOptions{}},
+		{
+			"values",
+			map[string]interface{}{"set": "a=1", "setString": "b=2", "setMap": map[string]string{"c": "x,y"}},
+			InstallOptions{Set: "a=1", SetString: "b=2", SetMap: map[string]string{"c": "x,y"}},
+		},
+		{
+			"dry run",
+			map[string]interface{}{"dryRun": true, "kubeVersion": "v1.20.0", "apiVersions": []string{"policy/v1"}},
+			InstallOptions{DryRun: true, KubeVersion: "v1.20.0", APIVersions: []string{"policy/v1"}},
+		},
+		{
+			"server dry run",
+			map[string]interface{}{"dryRun": dryRunServer},
+			InstallOptions{ServerDryRun: true},
+		},
+		{
+			"atomic upgrade",
+			map[string]interface{}{"atomic": true, "timeout": "1m30s", "cleanupOnFail": true, "historyMax": 3},
+			InstallOptions{Atomic: true, Timeout: 90 * time.Second, CleanupOnFail: true, HistoryMax: 3},
+		},
+		{"unlimited history", map[string]interface{}{"historyMax": 0}, InstallOptions{HistoryMax: -1}},
+		{"unset history", map[string]interface{}{"historyMax": nil}, InstallOptions{}},
+		{
+			"chart download",
+			map[string]interface{}{"downloadTimeout": "30s", "chartSHA256": "abc123", "verify": true},
+			InstallOptions{DownloadTimeout: 30 * time.Second, ChartSHA256: "abc123", Verify: true},
+		},
+	}
+	for _, tt := range tests {
+		got, err := installOptionsFromArgs(tt.args)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: installOptionsFromArgs() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, args := range []map[string]interface{}{
+		{"set": 1234},
+		{"apiVersions": "policy/v1"},
+		{"downloadTimeout": "soon"},
+	} {
+		if _, err := installOptionsFromArgs(args); err == nil {
+			t.Errorf("installOptionsFromArgs(%v) returned no error", args)
+		}
+	}
+}
+
+func TestInstallChartWithOptions(t *testing.T) {
+	h := NewHelmClientForTesting()
+
+	result, err := h.InstallChartWithOptions("web", testChart, testValues, testNamespace, InstallOptions{DryRun: true, Set: "replicaCount=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := h.ReleaseExists("web", testNamespace); err != nil || exists {
+		t.Errorf("dry run stored release: %v, %v", exists, err)
+	}
+	if result.Manifest == "" {
+		t.Error("dry run rendered no manifest")
+	}
+
+	opts := InstallOptions{Set: "replicaCount=2", SetString: "image.tag=1.20", Description: "first", Wait: true}
+	if _, err := h.InstallChartWithOptions("web", testChart, testValues, testNamespace, opts); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := h.GetReleaseValues("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(valueAt(vals, "replicaCount"), " ", valueAt(vals, "image.tag")); got != "2 1.20" {
+		t.Errorf("got replicaCount and image.tag %s, want 2 1.20", got)
+	}
+
+	opts = InstallOptions{Set: "service.port=8080", ReuseValues: true, Atomic: true}
+	result, err = h.InstallUpgradeChartWithOptions("web", testChart, testValues, testNamespace, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Revision != 2 {
+		t.Errorf("got revision %d, want 2", result.Revision)
+	}
+	vals, err = h.GetReleaseValues("web", testNamespace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(valueAt(vals, "replicaCount"), " ", valueAt(vals, "service.port")); got != "2 8080" {
+		t.Errorf("got replicaCount and service.port %s after reusing values, want 2 8080", got)
+	}
+	if _, err := h.InstallUpgradeChartWithOptions("web", testChart, testValues, testNamespace, InstallOptions{ReuseValues: true, ResetValues: true}); err == nil {
+		t.Error("expected ReuseValues with ResetValues to fail")
+	}
+}
+
+func TestInstallLoadedChart(t *testing.T) {
+	h := NewHelmClientForTesting()
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "generated", Version: "0.1.0"},
+		Templates: []*chart.File{{
+			Name: "templates/configmap.yaml",
+			Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}\ndata:\n  greeting: {{ .Values.greeting }}\n  name: {{ .Values.name }}\n"),
+		}},
+		Values: map[string]interface{}{"greeting": "hello", "name": "world"},
+	}
+	vals := map[string]interface{}{"greeting": "hi"}
+
+	result, err := h.InstallLoadedChart("generated", ch, vals, testNamespace, InstallOptions{Set: "name=gopher"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"greeting: hi", "name: gopher"} {
+		if !strings.Contains(result.Manifest, want) {
+			t.Errorf("got manifest %q, want it to contain %q", result.Manifest, want)
+		}
+	}
+	if len(vals) != 1 {
+		t.Errorf("the install modified vals to %v", vals)
+	}
+	rel, err := h.GetRelease("generated", testNamespace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Chart.Name() != "generated" || rel.Info.Status != release.StatusDeployed {
+		t.Errorf("got release of chart %s with status %s, want deployed generated", rel.Chart.Name(), rel.Info.Status)
+	}
+
+	if _, err := h.InstallLoadedChart("empty", nil, nil, testNamespace, InstallOptions{}); err == nil {
+		t.Error("installing a nil chart succeeded")
+	}
+	if _, err := h.InstallLoadedChart("verified", ch, nil, testNamespace, InstallOptions{Verify: true}); err == nil {
+		t.Error("verifying a loaded chart succeeded")
+	}
+}
+
+func TestUpgradeIfHealthy(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "healthy", nil)
+	installTestChart(t, h, "broken", nil)
+	setReleaseStatus(t, h, "broken", testNamespace, release.StatusFailed)
+
+	opts := InstallOptions{Set: "replicaCount=2"}
+	if err := h.UpgradeIfHealthy("healthy", testChart, "", testNamespace, opts); err != nil {
+		t.Fatalf("upgrading a deployed release failed: %v", err)
+	}
+	if revision := lastRelease(t, h, "healthy", testNamespace).Version; revision != 2 {
+		t.Errorf("got revision %d after the upgrade, want 2", revision)
+	}
+
+	if err := h.UpgradeIfHealthy("broken", testChart, "", testNamespace, opts); !errors.Is(err, ErrReleaseNotHealthy) {
+		t.Errorf("upgrading a failed release returned %v, want ErrReleaseNotHealthy", err)
+	}
+	if history, err := h.GetHistory("broken", testNamespace, 0); err != nil || len(history) != 1 {
+		t.Errorf("GetHistory() = %+v, %v after the refused upgrade, want the failed revision only", history, err)
+	}
+
+	if err := h.UpgradeIfHealthy("missing", testChart, "", testNamespace, opts); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("upgrading a missing release returned %v, want ErrReleaseNotFound", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ResourceReadiness holds the state of one release resource after waiting
+type ResourceReadiness struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Ready     bool
+	// Message describes the state, e.g. "1/3 replicas available"
+	Message string
+}
+
+// ResourcesNotReadyError is returned when the release resources did not
+// become ready within the timeout of InstallOptions.Wait. Resources reports the
+// state of each resource when the wait gave up, errors.Is still matches
+// wait.ErrWaitTimeout.
+type ResourcesNotReadyError struct {
+	Release   string
+	Timeout   time.Duration
+	Resources []ResourceReadiness
+	Err       error
+}
+
+func (e *ResourcesNotReadyError) Error() string {
+	var notReady []string
+	for _, r := range e.Resources {
+		if !r.Ready {
+			notReady = append(notReady, fmt.Sprintf("%s/%s: %s", r.Kind, r.Name, r.Message))
+		}
+	}
+	msg := fmt.Sprintf("release %s resources not ready within %s", e.Release, e.Timeout)
+	if len(notReady) > 0 {
+		msg += " (" + strings.Join(notReady, ", ") + ")"
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *ResourcesNotReadyError) Unwrap() error {
+	return e.Err
+}
+
+// waitError adds context to the error returned when waiting for release
+// resources to become ready did not finish within timeout, reporting the
+// readiness of the resources of rel when known.
+func (h *HelmClient) waitError(actionConfig *action.Configuration, rel *release.Release, err error, name string, timeout time.Duration) error {
+	if !errors.Is(err, wait.ErrWaitTimeout) {
+		return err
+	}
+	notReady := &ResourcesNotReadyError{Release: name, Timeout: timeout, Err: err}
+	if rel != nil {
+		resources, errReadiness := h.resourceReadiness(actionConfig, rel.Manifest)
+		if errReadiness != nil {
+			h.logger().Error(errReadiness, "Failed to check readiness of release resources", "name", name)
+		}
+		notReady.Resources = resources
+	}
+	return notReady
+}
+
+// waitedReleaseResult is newReleaseResult with the readiness of the release
+// resources when opts.Wait or opts.Atomic made the install wait for them. A
+// failed readiness check only leaves Readiness empty, the release itself
+// succeeded.
+func (h *HelmClient) waitedReleaseResult(rel *release.Release, namespace string, opts InstallOptions) *ReleaseResult {
+	result := newReleaseResult(rel)
+	if opts.dryRun() != "" || !(opts.Wait || opts.Atomic) {
+		return result
+	}
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err == nil {
+		result.Readiness, err = h.resourceReadiness(actionConfig, rel.Manifest)
+	}
+	if err != nil {
+		h.logger().Error(err, "Failed to check readiness of release resources", "name", rel.Name, "namespace", namespace)
+	}
+	return result
+}
+
+// resourceReadiness fetches the resources of the manifest and reports
+// whether each is ready, like helm's wait judges them
+// https://github.com/helm/helm/blob/master/pkg/kube/wait.go
+func (h *HelmClient) resourceReadiness(actionConfig *action.Configuration, manifest string) ([]ResourceReadiness, error) {
+	resources, err := actionConfig.KubeClient.Build(bytes.NewBufferString(manifest), false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build release resources")
+	}
+	report := []ResourceReadiness{}
+	for _, info := range resources {
+		r := ResourceReadiness{
+			Kind:      info.Mapping.GroupVersionKind.Kind,
+			Name:      info.Name,
+			Namespace: info.Namespace,
+		}
+		if err := info.Get(); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "failed to get resource %s", info.Name)
+			}
+			r.Message = "not found"
+			report = append(report, r)
+			continue
+		}
+		obj, ok := info.Object.(*unstructured.Unstructured)
+		if !ok {
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(info.Object)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to convert resource %s", info.Name)
+			}
+			obj = &unstructured.Unstructured{Object: content}
+		}
+		r.Ready, r.Message = objectReady(r.Kind, obj)
+		report = append(report, r)
+	}
+	return report, nil
+}
+
+// objectReady tells whether the workload, pod, volume claim or service is
+// ready, other resources are ready once they exist
+func objectReady(kind string, obj *unstructured.Unstructured) (bool, string) {
+	status := func(field string) int64 {
+		val, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return val
+	}
+	desired := func(field string) int64 {
+		val, found, _ := unstructured.NestedInt64(obj.Object, "spec", field)
+		if !found {
+			return 1
+		}
+		return val
+	}
+	replicas := func(ready, want int64, what string) (bool, string) {
+		return ready >= want, fmt.Sprintf("%d/%d %s", ready, want, what)
+	}
+
+	switch kind {
+	case "Deployment":
+		if status("observedGeneration") < obj.GetGeneration() {
+			return false, "rollout not observed yet"
+		}
+		want := desired("replicas")
+		if status("updatedReplicas") < want {
+			return replicas(status("updatedReplicas"), want, "replicas updated")
+		}
+		return replicas(status("availableReplicas"), want, "replicas available")
+	case "StatefulSet", "ReplicaSet", "ReplicationController":
+		return replicas(status("readyReplicas"), desired("replicas"), "replicas ready")
+	case "DaemonSet":
+		return replicas(status("numberReady"), status("desiredNumberScheduled"), "pods ready")
+	case "Job":
+		return replicas(status("succeeded"), desired("completions"), "completions")
+	case "Pod":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			if cond, ok := c.(map[string]interface{}); ok && cond["type"] == "Ready" {
+				if cond["status"] == "True" {
+					return true, "ready"
+				}
+			}
+		}
+		phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		return false, "pod not ready, phase " + phase
+	case "PersistentVolumeClaim":
+		phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		return phase == "Bound", "phase " + phase
+	case "Service":
+		serviceType, _, _ := unstructured.NestedString(obj.Object, "spec", "type")
+		if serviceType != "LoadBalancer" {
+			return true, "exists"
+		}
+		ingress, _, _ := unstructured.NestedSlice(obj.Object, "status", "loadBalancer", "ingress")
+		if len(ingress) == 0 {
+			return false, "load balancer not provisioned"
+		}
+		return true, "load balancer provisioned"
+	}
+	return true, "exists"
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/kube"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// timeoutKubeClient is jobKubeClient whose waits time out
+type timeoutKubeClient struct {
+	jobKubeClient
+}
+
+func (c *timeoutKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
+	return wait.ErrWaitTimeout
+}
+
+// newJobServer serves the job web-migrate with succeeded completions
+func newJobServer(t *testing.T, succeeded int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/batch/v1/namespaces/"+testNamespace+"/jobs/web-migrate" {
+			http.NotFound(w, r)
+			return
+		}
+		job := batchv1.Job{}
+		job.APIVersion, job.Kind, job.Name, job.Namespace = "batch/v1", "Job", "web-migrate", testNamespace
+		job.Status.Succeeded = succeeded
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestInstallChartReadiness(t *testing.T) {
+	server := newJobServer(t, 0)
+	want := []ResourceReadiness{{Kind: "Job", Name: "web-migrate", Namespace: testNamespace, Ready: false, Message: "0/1 completions"}}
+	for _, waited := range []bool{false, true} {
+		h := NewHelmClientForTesting()
+		setKubeClient(t, h, testNamespace, &jobKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}, host: server.URL})
+		result, err := h.InstallChart("web", testJobChart, testValues, testNamespace, map[string]interface{}{"wait": waited})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !waited {
+			if result.Readiness != nil {
+				t.Errorf("got readiness %+v without waiting", result.Readiness)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(result.Readiness, want) {
+			t.Errorf("got readiness %+v, want %+v", result.Readiness, want)
+		}
+	}
+}
+
+func TestInstallChartNotReadyError(t *testing.T) {
+	h := NewHelmClientForTesting()
+	server := newJobServer(t, 0)
+	setKubeClient(t, h, testNamespace, &timeoutKubeClient{jobKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}, host: server.URL}})
+
+	_, err := h.InstallChart("web", testJobChart, testValues, testNamespace, map[string]interface{}{"wait": true, "timeout": "1m"})
+	var notReady *ResourcesNotReadyError
+	if !errors.As(err, &notReady) {
+		t.Fatalf("got error %v, want a ResourcesNotReadyError", err)
+	}
+	if !errors.Is(err, wait.ErrWaitTimeout) {
+		t.Errorf("error %v does not match wait.ErrWaitTimeout", err)
+	}
+	want := []ResourceReadiness{{Kind: "Job", Name: "web-migrate", Namespace: testNamespace, Ready: false, Message: "0/1 completions"}}
+	if notReady.Release != "web" || notReady.Timeout != time.Minute || !reflect.DeepEqual(notReady.Resources, want) {
+		t.Errorf("got %+v, want release web not ready within 1m with resources %+v", notReady, want)
+	}
+}
+
+// waitRecordingKubeClient is jobKubeClient recording the timeouts of its
+// waits
+type waitRecordingKubeClient struct {
+	jobKubeClient
+	waits []time.Duration
+}
+
+func (c *waitRecordingKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
+	c.waits = append(c.waits, timeout)
+	return nil
+}
+
+func TestRollbackReleaseWithOptions(t *testing.T) {
+	h := NewHelmClientForTesting()
+	server := newJobServer(t, 0)
+	jobClient := jobKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}, host: server.URL}
+	setKubeClient(t, h, testNamespace, &jobClient)
+	if _, err := h.InstallChart("web", testJobChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts      RollbackOptions
+		wantWaits []time.Duration
+	}{
+		{RollbackOptions{}, nil},
+		{RollbackOptions{Wait: true}, []time.Duration{defaultTimeout}},
+		{RollbackOptions{Wait: true, Timeout: time.Minute}, []time.Duration{time.Minute}},
+	}
+	for _, tt := range tests {
+		kubeClient := &waitRecordingKubeClient{jobKubeClient: jobClient}
+		setKubeClient(t, h, testNamespace, kubeClient)
+		if err := h.RollbackReleaseWithOptions("web", testNamespace, 1, tt.opts); err != nil {
+			t.Fatalf("rollback with %+v failed: %v", tt.opts, err)
+		}
+		if !reflect.DeepEqual(kubeClient.waits, tt.wantWaits) {
+			t.Errorf("rollback with %+v waited %v, want %v", tt.opts, kubeClient.waits, tt.wantWaits)
+		}
+	}
+
+	setKubeClient(t, h, testNamespace, &timeoutKubeClient{jobClient})
+	err := h.RollbackReleaseWithOptions("web", testNamespace, 1, RollbackOptions{Wait: true, Timeout: time.Minute})
+	var notReady *ResourcesNotReadyError
+	if !errors.As(err, &notReady) {
+		t.Fatalf("got error %v, want a ResourcesNotReadyError", err)
+	}
+	want := []ResourceReadiness{{Kind: "Job", Name: "web-migrate", Namespace: testNamespace, Ready: false, Message: "0/1 completions"}}
+	if notReady.Release != "web" || notReady.Timeout != time.Minute || !reflect.DeepEqual(notReady.Resources, want) {
+		t.Errorf("got %+v, want release web not ready within 1m with resources %+v", notReady, want)
+	}
+}
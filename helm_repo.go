@@ -0,0 +1,280 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// repoFileMutex serializes the updates of the repository config file.
+// Unlike the helm CLI no file lock is taken, so other processes editing the
+// file at the same time are not guarded against.
+var repoFileMutex sync.Mutex
+
+// RepoEntry holds one chart repository of the repository config file
+type RepoEntry struct {
+	Name string
+	URL  string
+	// OCI is set for oci:// registries rather than index based repos
+	OCI bool
+}
+
+// SearchResult holds one chart found by SearchRepo
+type SearchResult struct {
+	// Name is the chart name prefixed with its repository, e.g. "bitnami/nginx"
+	Name        string
+	Version     string
+	AppVersion  string
+	Description string
+}
+
+// ListRepositories returns the chart repositories configured in the helm
+// repository config file like `helm repo list`. A missing file means no
+// repositories.
+func (h *HelmClient) ListRepositories() ([]RepoEntry, error) {
+	settings := h.newSettings()
+	// https://github.com/helm/helm/blob/master/cmd/helm/repo_list.go
+	repoFile, err := loadRepoFile(settings.RepositoryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []RepoEntry{}
+	for _, re := range repoFile.Repositories {
+		entries = append(entries, RepoEntry{
+			Name: re.Name,
+			URL:  re.URL,
+			OCI:  strings.HasPrefix(re.URL, "oci://"),
+		})
+	}
+	return entries, nil
+}
+
+// AddRepository adds the chart repository at url to the repository config
+// file like `helm repo add` after downloading its index. Adding an existing
+// name with the same url and credentials is a no-op, with a different one
+// it fails unless force is set, which replaces the entry.
+func (h *HelmClient) AddRepository(name, url, username, password string, force bool) error {
+	if strings.HasPrefix(url, "oci://") {
+		return errors.Wrapf(ErrOCINotSupported, "repository %s", url)
+	}
+	repoFileMutex.Lock()
+	defer repoFileMutex.Unlock()
+
+	settings := h.newSettings()
+	repoFile, err := loadRepoFile(settings.RepositoryConfig)
+	if err != nil {
+		return err
+	}
+
+	entry := &repo.Entry{
+		Name:     name,
+		URL:      url,
+		Username: username,
+		Password: password,
+	}
+	if existing := repoFile.Get(name); existing != nil && !force {
+		if *existing == *entry {
+			return nil
+		}
+		return errors.Errorf("repository %s already exists with url %s", name, existing.URL)
+	}
+
+	// https://github.com/helm/helm/blob/master/cmd/helm/repo_add.go
+	chartRepo, err := repo.NewChartRepository(entry, getter.All(settings))
+	if err != nil {
+		return err
+	}
+	chartRepo.CachePath = settings.RepositoryCache
+	if _, err := chartRepo.DownloadIndexFile(); err != nil {
+		h.logger().Error(err, "Failed to download repository index", "name", name, "url", url)
+		return errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", url)
+	}
+
+	repoFile.Update(entry)
+	if err := os.MkdirAll(filepath.Dir(settings.RepositoryConfig), 0755); err != nil {
+		return err
+	}
+	if err := repoFile.WriteFile(settings.RepositoryConfig, 0644); err != nil {
+		return err
+	}
+	h.logger().Info("Added chart repository", "name", name, "url", url)
+	return nil
+}
+
+// RemoveRepository removes the chart repository from the repository config
+// file like `helm repo remove`, together with its cached index
+func (h *HelmClient) RemoveRepository(name string) error {
+	repoFileMutex.Lock()
+	defer repoFileMutex.Unlock()
+
+	settings := h.newSettings()
+	repoFile, err := loadRepoFile(settings.RepositoryConfig)
+	if err != nil {
+		return err
+	}
+	// https://github.com/helm/helm/blob/master/cmd/helm/repo_remove.go
+	if !repoFile.Remove(name) {
+		return errors.Errorf("no repository named %s found", name)
+	}
+	if err := repoFile.WriteFile(settings.RepositoryConfig, 0644); err != nil {
+		return err
+	}
+
+	indexFile := filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(name))
+	if err := os.Remove(indexFile); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove index of repository %s", name)
+	}
+	h.logger().Info("Removed chart repository", "name", name)
+	return nil
+}
+
+// UpdateRepositories downloads the latest index of the named repositories,
+// of all configured ones when no names are given, like `helm repo update`.
+// A failing repository does not stop the others from being updated, the
+// failures are returned together.
+func (h *HelmClient) UpdateRepositories(names ...string) error {
+	repoFileMutex.Lock()
+	defer repoFileMutex.Unlock()
+
+	settings := h.newSettings()
+	repoFile, err := loadRepoFile(settings.RepositoryConfig)
+	if err != nil {
+		return err
+	}
+
+	entries := repoFile.Repositories
+	if len(names) > 0 {
+		entries = nil
+		for _, name := range names {
+			entry := repoFile.Get(name)
+			if entry == nil {
+				return errors.Errorf("no repository named %s found", name)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	// https://github.com/helm/helm/blob/master/cmd/helm/repo_update.go
+	var errs []error
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.URL, "oci://") {
+			continue
+		}
+		chartRepo, err := repo.NewChartRepository(entry, getter.All(settings))
+		if err == nil {
+			chartRepo.CachePath = settings.RepositoryCache
+			_, err = chartRepo.DownloadIndexFile()
+		}
+		if err != nil {
+			h.logger().Error(err, "Failed to update repository index", "name", entry.Name, "url", entry.URL)
+			errs = append(errs, errors.Wrapf(err, "failed to update repository %s", entry.Name))
+			continue
+		}
+		h.logger().Info("Updated repository index", "name", entry.Name, "url", entry.URL)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// SearchRepo searches the cached indexes of the configured repositories like
+// `helm search repo`. keyword is matched case-insensitively against the chart
+// name, description and keywords, an empty keyword matches every chart. The
+// latest version of each chart matching versionConstraint is returned, the
+// latest stable one when it is empty. devel includes pre-release versions.
+func (h *HelmClient) SearchRepo(keyword, versionConstraint string, devel bool) ([]SearchResult, error) {
+	if err := validateVersionConstraint(versionConstraint); err != nil {
+		return nil, err
+	}
+	if versionConstraint == "" {
+		versionConstraint = ">0.0.0"
+	}
+	if devel {
+		// like helm, a pre-release suffix makes prereleases match
+		versionConstraint += "-0"
+	}
+	constraint, err := semver.NewConstraint(versionConstraint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid chart version constraint %q", versionConstraint)
+	}
+
+	settings := h.newSettings()
+	repoFile, err := loadRepoFile(settings.RepositoryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// https://github.com/helm/helm/blob/master/cmd/helm/search_repo.go
+	keyword = strings.ToLower(keyword)
+	results := []SearchResult{}
+	for _, entry := range repoFile.Repositories {
+		indexPath := filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(entry.Name))
+		index, err := repo.LoadIndexFile(indexPath)
+		if err != nil {
+			// like helm, repositories without a usable index are skipped
+			h.logger().Info("Skipping repository without cached index, run UpdateRepositories", "name", entry.Name, "error", err.Error())
+			continue
+		}
+		for chartName, versions := range index.Entries {
+			// versions are sorted newest first
+			for _, version := range versions {
+				if !chartMatches(version, keyword) {
+					continue
+				}
+				v, err := semver.NewVersion(version.Version)
+				if err != nil || !constraint.Check(v) {
+					continue
+				}
+				results = append(results, SearchResult{
+					Name:        entry.Name + "/" + chartName,
+					Version:     version.Version,
+					AppVersion:  version.AppVersion,
+					Description: version.Description,
+				})
+				break
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// chartMatches tells whether the lowercase keyword is part of the name,
+// description or keywords of the chart version
+func chartMatches(version *repo.ChartVersion, keyword string) bool {
+	if strings.Contains(strings.ToLower(version.Name), keyword) ||
+		strings.Contains(strings.ToLower(version.Description), keyword) {
+		return true
+	}
+	for _, kw := range version.Keywords {
+		if strings.Contains(strings.ToLower(kw), keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRepoFile loads the repository config file, an empty one when it is
+// missing
+func loadRepoFile(path string) (*repo.File, error) {
+	repoFile, err := repo.LoadFile(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return repo.NewFile(), nil
+		}
+		return nil, err
+	}
+	return repoFile, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/helmpath"
+)
+
+func TestListRepositories(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+
+	entries, err := h.ListRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got repositories %v without a repository config, want none", entries)
+	}
+
+	config := os.Getenv("HELM_REPOSITORY_CONFIG")
+	writeTestFile(t, filepath.Dir(config), filepath.Base(config), `apiVersion: v1
+repositories:
+  - name: bitnami
+    url: https://charts.bitnami.com/bitnami
+  - name: internal
+    url: oci://registry.example.com/charts
+`)
+	entries, err = h.ListRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RepoEntry{
+		{Name: "bitnami", URL: "https://charts.bitnami.com/bitnami"},
+		{Name: "internal", URL: "oci://registry.example.com/charts", OCI: true},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ListRepositories() = %+v, want %+v", entries, want)
+	}
+}
+
+func TestAddRemoveRepository(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	server := newTestRepo(t, "", "", "0.1.0")
+	other := newTestRepo(t, "", "", "0.1.0")
+
+	if err := h.AddRepository("test", server.URL, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	indexFile := filepath.Join(os.Getenv("HELM_REPOSITORY_CACHE"), helmpath.CacheIndexFile("test"))
+	if _, err := os.Stat(indexFile); err != nil {
+		t.Errorf("index of the added repository was not downloaded: %v", err)
+	}
+	// adding the same entry again is a no-op
+	if err := h.AddRepository("test", server.URL, "", "", false); err != nil {
+		t.Errorf("re-adding the same repository failed: %v", err)
+	}
+	if err := h.AddRepository("test", other.URL, "", "", false); err == nil {
+		t.Error("adding a duplicate name with another url succeeded without force")
+	}
+	if err := h.AddRepository("test", other.URL, "", "", true); err != nil {
+		t.Fatalf("adding a duplicate name with force failed: %v", err)
+	}
+	entries, err := h.ListRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RepoEntry{{Name: "test", URL: other.URL}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("repositories after forced add = %+v, want %+v", entries, want)
+	}
+
+	if err := h.RemoveRepository("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(indexFile); !os.IsNotExist(err) {
+		t.Errorf("index of the removed repository still exists: %v", err)
+	}
+	if entries, err := h.ListRepositories(); err != nil || len(entries) != 0 {
+		t.Errorf("repositories after remove = %v, %v, want none", entries, err)
+	}
+	if err := h.RemoveRepository("test"); err == nil {
+		t.Error("removing a missing repository succeeded")
+	}
+}
+
+func TestUpdateRepositories(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	server := newTestRepo(t, "", "", "0.1.0")
+	down := newTestRepo(t, "", "", "0.1.0")
+	if err := h.AddRepository("good", server.URL, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRepository("down", down.URL, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	cache := os.Getenv("HELM_REPOSITORY_CACHE")
+	goodIndex := filepath.Join(cache, helmpath.CacheIndexFile("good"))
+	if err := os.Remove(goodIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.UpdateRepositories("good"); err != nil {
+		t.Fatalf("updating a single repository failed: %v", err)
+	}
+	if _, err := os.Stat(goodIndex); err != nil {
+		t.Errorf("index of the updated repository was not downloaded: %v", err)
+	}
+
+	// a failing repository does not stop the others from being updated
+	if err := os.Remove(goodIndex); err != nil {
+		t.Fatal(err)
+	}
+	err := h.UpdateRepositories()
+	if err == nil || !strings.Contains(err.Error(), "down") {
+		t.Errorf("UpdateRepositories() error = %v, want the failure of repository down", err)
+	}
+	if _, err := os.Stat(goodIndex); err != nil {
+		t.Errorf("index of the reachable repository was not downloaded: %v", err)
+	}
+
+	if err := h.UpdateRepositories("missing"); err == nil {
+		t.Error("updating a missing repository succeeded")
+	}
+}
+
+func TestSearchRepo(t *testing.T) {
+	isolateHelmHome(t)
+	h := NewHelmClientForTesting()
+	config := os.Getenv("HELM_REPOSITORY_CONFIG")
+	writeTestFile(t, filepath.Dir(config), filepath.Base(config), `apiVersion: v1
+repositories:
+  - name: stable
+    url: https://charts.example.com/stable
+`)
+	cache := os.Getenv("HELM_REPOSITORY_CACHE")
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, cache, helmpath.CacheIndexFile("stable"), `apiVersion: v1
+entries:
+  nginx:
+    - name: nginx
+      version: 2.0.0-beta.1
+      appVersion: 1.21.0
+      description: NGINX web server
+      urls: [https://charts.example.com/stable/nginx-2.0.0-beta.1.tgz]
+    - name: nginx
+      version: 1.1.0
+      appVersion: 1.20.0
+      description: NGINX web server
+      urls: [https://charts.example.com/stable/nginx-1.1.0.tgz]
+    - name: nginx
+      version: 1.0.0
+      appVersion: 1.19.0
+      description: NGINX web server
+      urls: [https://charts.example.com/stable/nginx-1.0.0.tgz]
+  redis:
+    - name: redis
+      version: 3.0.0
+      appVersion: 6.0.0
+      description: In-memory data store
+      keywords: [cache, database]
+      urls: [https://charts.example.com/stable/redis-3.0.0.tgz]
+`)
+
+	tests := []struct {
+		keyword           string
+		versionConstraint string
+		devel             bool
+		want              []string
+	}{
+		{"", "", false, []string{"stable/nginx@1.1.0", "stable/redis@3.0.0"}},
+		{"NGINX", "", false, []string{"stable/nginx@1.1.0"}},
+		{"nginx", "", true, []string{"stable/nginx@2.0.0-beta.1"}},
+		{"nginx", "<1.1.0", false, []string{"stable/nginx@1.0.0"}},
+		{"web server", "", false, []string{"stable/nginx@1.1.0"}},
+		{"cache", "", false, []string{"stable/redis@3.0.0"}},
+		{"nginx", ">=5.0.0", false, []string{}},
+		{"postgres", "", false, []string{}},
+	}
+	for _, tt := range tests {
+		results, err := h.SearchRepo(tt.keyword, tt.versionConstraint, tt.devel)
+		if err != nil {
+			t.Fatalf("SearchRepo(%q, %q, %v) failed: %v", tt.keyword, tt.versionConstraint, tt.devel, err)
+		}
+		got := []string{}
+		for _, result := range results {
+			got = append(got, result.Name+"@"+result.Version)
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("SearchRepo(%q, %q, %v) = %v, want %v", tt.keyword, tt.versionConstraint, tt.devel, got, tt.want)
+		}
+	}
+
+	if _, err := h.SearchRepo("nginx", "not a constraint", false); err == nil {
+		t.Error("expected an invalid version constraint to fail")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/releaseutil"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// ResourceRef identifies one Kubernetes resource of a release manifest
+type ResourceRef struct {
+	Group   string
+	Version string
+	Kind    string
+	Name    string
+	// Namespace is empty for cluster-scoped resources; for resources whose
+	// manifest names no namespace GetReleaseResources also leaves it empty,
+	// they live in the release namespace
+	Namespace string
+}
+
+// GetReleaseResources returns the resources of the manifest of the latest
+// release revision in manifest order, hooks are not part of it. Non-empty
+// kinds, e.g. "Deployment", limit the result to resources of those kinds.
+// The cluster is not contacted, see GetLiveReleaseResources.
+func (h *HelmClient) GetReleaseResources(name, namespace string, kinds ...string) ([]ResourceRef, error) {
+	manifest, err := h.GetReleaseManifest(name, namespace, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(manifests))
+	for key := range manifests {
+		keys = append(keys, key)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	refs := []ResourceRef{}
+	for _, key := range keys {
+		var head struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(manifests[key]), &head); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse manifest of release %s", name)
+		}
+		if head.Kind == "" || !kindMatches(head.Kind, kinds) {
+			continue
+		}
+		gvk := schema.FromAPIVersionAndKind(head.APIVersion, head.Kind)
+		refs = append(refs, ResourceRef{
+			Group:     gvk.Group,
+			Version:   gvk.Version,
+			Kind:      gvk.Kind,
+			Name:      head.Metadata.Name,
+			Namespace: head.Metadata.Namespace,
+		})
+	}
+	return refs, nil
+}
+
+// GetLiveReleaseResources is GetReleaseResources limited to the resources
+// still present in the cluster. Namespaces are resolved, namespaced
+// resources always have theirs set.
+func (h *HelmClient) GetLiveReleaseResources(name, namespace string, kinds ...string) ([]ResourceRef, error) {
+	rel, err := h.GetRelease(name, namespace, 0)
+	if err != nil {
+		return nil, err
+	}
+	actionConfig, err := h.getHelmActionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := actionConfig.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build resources of release %s", name)
+	}
+
+	refs := []ResourceRef{}
+	for _, info := range resources {
+		gvk := info.Mapping.GroupVersionKind
+		if !kindMatches(gvk.Kind, kinds) {
+			continue
+		}
+		if err := info.Get(); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to get resource %s of release %s", info.Name, name)
+		}
+		refs = append(refs, ResourceRef{
+			Group:     gvk.Group,
+			Version:   gvk.Version,
+			Kind:      gvk.Kind,
+			Name:      info.Name,
+			Namespace: info.Namespace,
+		})
+	}
+	return refs, nil
+}
+
+// kindMatches tells whether kind is one of kinds, ignoring case. Empty kinds
+// match every kind.
+func kindMatches(kind string, kinds []string) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if strings.EqualFold(kind, k) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+func TestGetReleaseResources(t *testing.T) {
+	h := NewHelmClientForTesting()
+	installTestChart(t, h, "web", nil)
+
+	refs, err := h.GetReleaseResources("web", testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in helm's install order
+	want := []ResourceRef{
+		{Version: "v1", Kind: "Service", Name: "web"},
+		{Group: "apps", Version: "v1", Kind: "Deployment", Name: "web"},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("GetReleaseResources() = %+v, want %+v", refs, want)
+	}
+
+	refs, err = h.GetReleaseResources("web", testNamespace, "deployment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refs, want[1:]) {
+		t.Errorf("GetReleaseResources(deployment) = %+v, want %+v", refs, want[1:])
+	}
+
+	if _, err := h.GetReleaseResources("missing", testNamespace); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("got error %v for a missing release, want ErrReleaseNotFound", err)
+	}
+}
+
+func TestGetLiveReleaseResources(t *testing.T) {
+	h := NewHelmClientForTesting()
+	if _, err := h.InstallChart("web", testJobChart, testValues, testNamespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	live := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !live || r.URL.Path != "/apis/batch/v1/namespaces/"+testNamespace+"/jobs/web-migrate" {
+			http.NotFound(w, r)
+			return
+		}
+		job := batchv1.Job{}
+		job.APIVersion, job.Kind, job.Name, job.Namespace = "batch/v1", "Job", "web-migrate", testNamespace
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	updateActionConfig(t, h, testNamespace, func(cfg *action.Configuration) {
+		cfg.KubeClient = &jobKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard}, host: server.URL}
+	})
+
+	refs, err := h.GetLiveReleaseResources("web", testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ResourceRef{{Group: "batch", Version: "v1", Kind: "Job", Name: "web-migrate", Namespace: testNamespace}}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("GetLiveReleaseResources() = %+v, want %+v", refs, want)
+	}
+
+	live = false
+	refs, err = h.GetLiveReleaseResources("web", testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("GetLiveReleaseResources() = %+v for a deleted job, want none", refs)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// NewHelmClientForTesting returns a client that keeps releases in memory and
+// applies nothing to a cluster, so install, upgrade, list and uninstall flows
+// can be exercised without one. Operations that talk to the cluster
+// directly, like fetching test pod logs, still need a kubeconfig.
+func NewHelmClientForTesting() *HelmClient {
+	h := NewHelmClient()
+	h.memory = &memoryReleases{mem: driver.NewMemory()}
+	return h
+}
+
+// newTestingActionConfig is newMemoryActionConfig keeping the releases in the
+// memory of the testing client
+func (h *HelmClient) newTestingActionConfig(namespace string) *action.Configuration {
+	cfg := h.newMemoryActionConfig(namespace)
+	cfg.Releases = storage.Init(namespaceDriver{memoryReleases: h.memory, namespace: namespace})
+	return cfg
+}
+
+// newMemoryActionConfig returns an action configuration backed by the memory
+// storage driver and a kube client that only accepts the resources
+// https://github.com/helm/helm/blob/master/pkg/action/action_test.go
+func (h *HelmClient) newMemoryActionConfig(namespace string) *action.Configuration {
+	mem := driver.NewMemory()
+	mem.SetNamespace(namespace)
+	// chartutil.DefaultCapabilities is shared by every client
+	caps := *chartutil.DefaultCapabilities
+	caps.APIVersions = append(chartutil.VersionSet{}, caps.APIVersions...)
+	return &action.Configuration{
+		RESTClientGetter: newRESTClientGetter(h.newSettings(), namespace),
+		Releases:         storage.Init(mem),
+		KubeClient:       &kubefake.PrintingKubeClient{Out: io.Discard},
+		Capabilities:     &caps,
+		Log: func(format string, args ...interface{}) {
+			h.logger().Info(fmt.Sprintf(format, args...))
+		},
+	}
+}
+
+// memoryReleases is a memory driver shared by the namespaces of a testing
+// client, so ListAllReleases sees the releases of all of them
+type memoryReleases struct {
+	// mu serializes the calls as the driver keeps the namespace it serves
+	// in a field
+	mu  sync.Mutex
+	mem *driver.Memory
+}
+
+// namespaceDriver is the driver of memoryReleases for namespace, empty for
+// all namespaces
+type namespaceDriver struct {
+	*memoryReleases
+	namespace string
+}
+
+var _ driver.Driver = namespaceDriver{}
+
+func (d namespaceDriver) lock() func() {
+	d.mu.Lock()
+	d.mem.SetNamespace(d.namespace)
+	return d.mu.Unlock
+}
+
+func (d namespaceDriver) Name() string {
+	return d.mem.Name()
+}
+
+func (d namespaceDriver) Get(key string) (*release.Release, error) {
+	defer d.lock()()
+	return d.mem.Get(key)
+}
+
+func (d namespaceDriver) List(filter func(*release.Release) bool) ([]*release.Release, error) {
+	defer d.lock()()
+	return d.mem.List(filter)
+}
+
+func (d namespaceDriver) Query(labels map[string]string) ([]*release.Release, error) {
+	defer d.lock()()
+	return d.mem.Query(labels)
+}
+
+func (d namespaceDriver) Create(key string, rls *release.Release) error {
+	defer d.lock()()
+	return d.mem.Create(key, rls)
+}
+
+func (d namespaceDriver) Update(key string, rls *release.Release) error {
+	defer d.lock()()
+	return d.mem.Update(key, rls)
+}
+
+func (d namespaceDriver) Delete(key string) (*release.Release, error) {
+	defer d.lock()()
+	return d.mem.Delete(key)
+}
@@ -0,0 +1,3 @@
+{{- define "librarychart.labels" -}}
+app.kubernetes.io/name: {{ .Chart.Name }}
+{{- end -}}